@@ -0,0 +1,354 @@
+/*
+Copyright Tanla Solutions Ltd. 2019 All Rights Reserved.
+Batch upload of preferences with a structured per-row report
+carrying the row index, outcome and machine-readable error codes.
+*/
+
+package main
+
+import (
+	"encoding/json" //reading and writing JSON
+	"strconv"       //import for msisdn validation
+	"strings"
+
+	"github.com/beerumicroservice/blockChain/events"    // import for Batch Event payload
+	"github.com/hyperledger/fabric/core/chaincode/shim" // import for Chaincode Interface
+	pb "github.com/hyperledger/fabric/protos/peer"      // import for peer response
+)
+
+//Batch Modes
+const BATCHATOMIC = "atomic"
+const BATCHBESTEFFORT = "besteffort"
+
+//Row Outcomes
+const OUTCOMECREATED = "created"
+const OUTCOMEUPDATED = "updated"
+const OUTCOMEREJECTED = "rejected"
+const OUTCOMESKIPPED = "skipped"
+const OUTCOMEDELETED = "deleted"
+const OUTCOMEPORTED = "ported"
+
+//Error Codes
+const ERRINVALIDJSON = "INVALID_JSON"
+const ERRMISSINGFIELD = "MISSING_FIELD"
+const ERRUNKNOWNFIELD = "UNKNOWN_FIELD"
+const ERRMSISDNNOTNUMERIC = "MSISDN_NOT_NUMERIC"
+const ERRMSISDNLENGTH = "MSISDN_INVALID_LENGTH"
+const ERRLRNNOTNUMERIC = "LRN_NOT_NUMERIC"
+const ERRUNAUTHORIZED = "UNAUTHORIZED"
+const ERRDUPLICATEINBATCH = "DUPLICATE_IN_BATCH"
+const ERRNOTFOUND = "NOT_FOUND"
+const ERRTIMENOTNUMERIC = "TIME_NOT_NUMERIC"
+const ERRSAMEOPERATOR = "SAME_OPERATOR"
+const ERRBATCHTOOLARGE = "BATCH_TOO_LARGE"
+
+//batchTooLargeResp is the error response for a batch with more rows than the configured maximum
+func batchTooLargeResp(rows int, config *Config) string {
+	return "{\"Error\":\"Batch of " + strconv.Itoa(rows) + " rows exceeds the maximum batch size of " + strconv.Itoa(config.MaxBatchSize) + " \",\"Code\":\"" + ERRBATCHTOOLARGE + "\"}"
+}
+
+//preferenceFields are the keys expected in a preference input json
+var preferenceFields = []string{"msisdn", "svcprv", "reqno", "rmode", "ctgr", "cmode", "day", "time", "lrn", "uts", "cts"}
+
+//RowError Structure for a machine-readable error of a batch row
+type RowError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+//RowReport Structure for the outcome of a batch row, Row is the zero based position of the row in the batch
+//and CollapsedInto the row applied in place of a skipped duplicate, the last row of the MSISDN passing the
+//state checks
+type RowReport struct {
+	Row           int        `json:"row"`
+	Phone         string     `json:"msisdn"`
+	Outcome       string     `json:"outcome"`
+	CollapsedInto *int       `json:"collapsedInto,omitempty"`
+	Errors        []RowError `json:"errors,omitempty"`
+}
+
+//BatchSummary Structure for the outcome counts of a batch
+type BatchSummary struct {
+	Total    int `json:"total"`
+	Created  int `json:"created"`
+	Updated  int `json:"updated"`
+	Rejected int `json:"rejected"`
+	Skipped  int `json:"skipped"`
+	Deleted  int `json:"deleted,omitempty"`
+	Ported   int `json:"ported,omitempty"`
+}
+
+//BatchReport Structure for the batch response
+type BatchReport struct {
+	Txid    string       `json:"txid"`
+	Mode    string       `json:"mode"`
+	Summary BatchSummary `json:"summary"`
+	Rows    []RowReport  `json:"rows"`
+}
+
+//add records the row in the report and counts its outcome
+func (report *BatchReport) add(row RowReport) {
+	report.Rows = append(report.Rows, row)
+	report.Summary.Total = report.Summary.Total + 1
+	switch row.Outcome {
+	case OUTCOMECREATED:
+		report.Summary.Created = report.Summary.Created + 1
+	case OUTCOMEUPDATED:
+		report.Summary.Updated = report.Summary.Updated + 1
+	case OUTCOMEREJECTED:
+		report.Summary.Rejected = report.Summary.Rejected + 1
+	case OUTCOMESKIPPED:
+		report.Summary.Skipped = report.Summary.Skipped + 1
+	case OUTCOMEDELETED:
+		report.Summary.Deleted = report.Summary.Deleted + 1
+	case OUTCOMEPORTED:
+		report.Summary.Ported = report.Summary.Ported + 1
+	}
+}
+
+//containsField checks whether the key is one of the expected input json fields
+func containsField(fields []string, field string) bool {
+	for _, expected := range fields {
+		if field == expected {
+			return true
+		}
+	}
+	return false
+}
+
+//validateMsisdn validates the format of an MSISDN of a batch row
+func validateMsisdn(msisdn string) []RowError {
+	var rowErrors []RowError
+	if _, err := strconv.Atoi(msisdn); err != nil {
+		rowErrors = append(rowErrors, RowError{Code: ERRMSISDNNOTNUMERIC, Message: "MSISDN is not numeric"})
+	}
+	if len(msisdn) < 10 {
+		rowErrors = append(rowErrors, RowError{Code: ERRMSISDNLENGTH, Message: "MSISDN is not a valid length"})
+	}
+	return rowErrors
+}
+
+//parsePreferenceRow unmarshals a preference input json and validates its fields and format
+func parsePreferenceRow(raw string) (map[string]string, []RowError) {
+	var input map[string]interface{}
+	if err := json.Unmarshal([]byte(raw), &input); err != nil {
+		return nil, []RowError{{Code: ERRINVALIDJSON, Message: err.Error()}}
+	}
+	var rowErrors []RowError
+	data := make(map[string]string)
+	for _, field := range preferenceFields {
+		value, ok := input[field].(string)
+		if !ok {
+			rowErrors = append(rowErrors, RowError{Code: ERRMISSINGFIELD, Message: field + " is missing or not a string"})
+			continue
+		}
+		data[field] = value
+	}
+	if len(input) > len(data) {
+		for field := range input {
+			if _, ok := data[field]; !ok && !containsField(preferenceFields, field) {
+				rowErrors = append(rowErrors, RowError{Code: ERRUNKNOWNFIELD, Message: field + " is not a preference field"})
+			}
+		}
+	}
+	if msisdn, ok := data["msisdn"]; ok {
+		rowErrors = append(rowErrors, validateMsisdn(msisdn)...)
+	}
+	if lrn, ok := data["lrn"]; ok {
+		if _, err := strconv.Atoi(lrn); err != nil {
+			rowErrors = append(rowErrors, RowError{Code: ERRLRNNOTNUMERIC, Message: "LRN is not numeric"})
+		}
+	}
+	return data, rowErrors
+}
+
+//collapseRows skips the rows of an MSISDN before the applied row as collapsed into it, the rows after it
+//are left with the errors of their state checks
+func collapseRows(reports []RowReport, group []int, applied int) {
+	for _, i := range group {
+		if i >= applied {
+			return
+		}
+		reports[i].Outcome = OUTCOMESKIPPED
+		reports[i].CollapsedInto = &applied
+		reports[i].Errors = append(reports[i].Errors, RowError{Code: ERRDUPLICATEINBATCH, Message: "MSISDN is applied from row " + strconv.Itoa(applied) + " of the batch"})
+	}
+}
+
+//newPreference builds the preference from the validated input fields
+func newPreference(data map[string]string, organization string) *Preference {
+	PrfStruct := &Preference{}
+	PrfStruct.ObjType = "Preferences"
+	PrfStruct.Phone = data["msisdn"]
+	PrfStruct.ServiceProvider = data["svcprv"]
+	PrfStruct.RequestNumber = data["reqno"]
+	PrfStruct.RegistrationMode = data["rmode"]
+	PrfStruct.Category = data["ctgr"]
+	PrfStruct.CommunicationMode = data["cmode"]
+	PrfStruct.DayType = data["day"]
+	PrfStruct.DayTimeBand = data["time"]
+	PrfStruct.Lrn = data["lrn"]
+	PrfStruct.UpdateTs = data["uts"]
+	PrfStruct.CreateTs = data["cts"]
+	PrfStruct.UpdatedBy = organization
+	return PrfStruct
+}
+
+//======================================================
+//batchPreferences for Uploading Bulk Preferences into DL
+//The first argument may select the mode, atomic or besteffort (default).
+//In atomic mode any row failure fails the whole transaction.
+//The caller identity and configuration are resolved once, a batch larger
+//than the configured maxbatch is refused before any row is read, and every
+//row is validated before the state of any MSISDN is read.
+//The response is a json BatchReport with the outcome of every row.
+//When an MSISDN appears in several valid rows its state is read once and
+//the rows are checked from the last one back, the last row passing the
+//ownership, interval and LRN checks is applied and the earlier rows are
+//skipped as collapsed into it. The later rows are rejected with the errors
+//of their checks, so a failing correction never discards a valid row and
+//every MSISDN is written once per transaction. The applied rows are
+//published in a single BATCH-PREFERENCES event
+//=======================================================
+
+func (dlp *CPM) batchPreferences(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	mode := BATCHBESTEFFORT
+	if len(args) > 0 && (args[0] == BATCHATOMIC || args[0] == BATCHBESTEFFORT) {
+		mode = args[0]
+		args = args[1:]
+	}
+	organization, err := getOrganization(stub)
+	if err != nil {
+		logger.Errorf("batchPreferences : Getting certificate Details Error : " + string(err.Error()))
+		return shim.Error("batchPreferences : Getting certificate Details Error : " + string(err.Error()))
+	}
+	config, err := getConfig(stub)
+	if err != nil {
+		logger.Errorf("batchPreferences : GetState Failed for Config Error : " + string(err.Error()))
+		return shim.Error("batchPreferences : GetState Failed for Config Error : " + string(err.Error()))
+	}
+	if len(args) > config.MaxBatchSize {
+		logger.Errorf("batchPreferences : " + batchTooLargeResp(len(args), config))
+		return shim.Error(batchTooLargeResp(len(args), config))
+	}
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		logger.Errorf("batchPreferences : Getting Transaction Timestamp Error : " + string(err.Error()))
+		return shim.Error("batchPreferences : Getting Transaction Timestamp Error : " + string(err.Error()))
+	}
+	report := BatchReport{Txid: stub.GetTxID(), Mode: mode, Rows: []RowReport{}}
+	var items []events.BatchItem
+	rows := make([]map[string]string, len(args))
+	reports := make([]RowReport, len(args))
+	groups := make(map[string][]int)
+	for i := 0; i < len(args); i++ {
+		logger.Debugf("batchPreferences : Row " + strconv.Itoa(i) + " : " + args[i])
+		var rowErrors []RowError
+		rows[i], rowErrors = parsePreferenceRow(args[i])
+		reports[i] = RowReport{Row: i, Phone: rows[i]["msisdn"], Outcome: OUTCOMEREJECTED, Errors: rowErrors}
+		if len(rowErrors) == 0 {
+			groups[rows[i]["msisdn"]] = append(groups[rows[i]["msisdn"]], i)
+		}
+	}
+	//The rows of an MSISDN are resolved together at its last valid row
+	for i := 0; i < len(args); i++ {
+		group := groups[reports[i].Phone]
+		if len(reports[i].Errors) != 0 || group[len(group)-1] != i {
+			continue
+		}
+		phone := reports[i].Phone
+		value, err := stub.GetState(phone)
+		if err != nil {
+			logger.Errorf("batchPreferences : GetState Failed for MSISDN : " + phone + " , Error : " + string(err.Error()))
+			return shim.Error("batchPreferences : GetState Failed for MSISDN : " + phone + " , Error : " + string(err.Error()))
+		}
+		churned, err := isChurnedNumber(stub, phone, value)
+		if err != nil {
+			logger.Errorf("batchPreferences : GetState Failed for Churn of MSISDN : " + phone + " , Error : " + string(err.Error()))
+			return shim.Error("batchPreferences : GetState Failed for Churn of MSISDN : " + phone + " , Error : " + string(err.Error()))
+		}
+		var stateError *RowError
+		var existing *Preference
+		outcome := OUTCOMECREATED
+		if churned {
+			stateError = &RowError{Code: ERRCHURNED, Message: "MSISDN is churned, it is reused only after reallocation"}
+		} else if value != nil {
+			existing = &Preference{}
+			err := json.Unmarshal(value, existing)
+			if err != nil {
+				logger.Errorf("batchPreferences : Unmarhsaling Error : " + string(err.Error()))
+				return shim.Error("batchPreferences : Unmarhsaling Error : " + string(err.Error()))
+			}
+			outcome = OUTCOMEUPDATED
+			if strings.Compare(existing.UpdatedBy, organization) != 0 {
+				logger.Errorf("batchPreferences : Unauthorized Access for MSISDN : " + phone)
+				stateError = &RowError{Code: ERRUNAUTHORIZED, Message: "MSISDN is owned by another operator"}
+			} else if isChangeTooSoon(existing, config, txTime) {
+				logger.Errorf("batchPreferences : " + changeTooSoonResp)
+				stateError = &RowError{Code: ERRCHANGETOOSOON, Message: "Preference is changed within the minimum interval of the previous change"}
+			}
+		}
+		if stateError != nil {
+			for _, j := range group {
+				reports[j].Errors = append(reports[j].Errors, *stateError)
+			}
+			continue
+		}
+		applied := -1
+		for k := len(group) - 1; k >= 0 && applied < 0; k-- {
+			_, rowError, err := validateLrn(stub, rows[group[k]]["lrn"], organization, "")
+			if err != nil {
+				logger.Errorf("batchPreferences : GetState Failed for LRN : " + rows[group[k]]["lrn"] + " , Error : " + string(err.Error()))
+				return shim.Error("batchPreferences : GetState Failed for LRN : " + rows[group[k]]["lrn"] + " , Error : " + string(err.Error()))
+			}
+			if rowError != nil {
+				reports[group[k]].Errors = append(reports[group[k]].Errors, *rowError)
+				continue
+			}
+			applied = group[k]
+		}
+		if applied < 0 {
+			continue
+		}
+		collapseRows(reports, group, applied)
+		reports[applied].Outcome = outcome
+		PrfStruct := schedulePreference(existing, newPreference(rows[applied], organization), config, txTime)
+		PrfAsBytes, err := json.Marshal(PrfStruct)
+		if err != nil {
+			logger.Errorf("batchPreferences : Marshalling Error : " + string(err.Error()))
+			return shim.Error("batchPreferences : Marshalling Error : " + string(err.Error()))
+		}
+		//Inserting DataBlock to BlockChain
+		err = stub.PutState(PrfStruct.Phone, PrfAsBytes)
+		if err != nil {
+			logger.Errorf("batchPreferences : PutState Failed Error : " + string(err.Error()))
+			return shim.Error("batchPreferences : PutState Failed Error : " + string(err.Error()))
+		}
+		logger.Debugf("batchPreferences : PutState Success : " + string(PrfAsBytes))
+		err = trackPreferenceWrite(stub, existing, PrfStruct)
+		if err != nil {
+			logger.Errorf("batchPreferences : Index and Statistics Update Failed for MSISDN : " + phone + " , Error : " + string(err.Error()))
+			return shim.Error("batchPreferences : Index and Statistics Update Failed for MSISDN : " + phone + " , Error : " + string(err.Error()))
+		}
+		items = append(items, newBatchItem(PrfStruct.Phone, outcome, PrfAsBytes))
+	}
+	for _, row := range reports {
+		report.add(row)
+	}
+	err = publishBatchEvent(stub, config, EVTBATCHPREFERENCES, items)
+	if err != nil {
+		logger.Errorf("batchPreferences : Event Creation Error for EventID : " + string(EVTBATCHPREFERENCES) + " , Error : " + string(err.Error()))
+		return shim.Error("batchPreferences : Event Creation Error for EventID : " + string(EVTBATCHPREFERENCES) + " , Error : " + string(err.Error()))
+	}
+	ReportAsBytes, err := json.Marshal(report)
+	if err != nil {
+		logger.Errorf("batchPreferences : Report Marshalling Error : " + string(err.Error()))
+		return shim.Error("batchPreferences : Report Marshalling Error : " + string(err.Error()))
+	}
+	logger.Infof("batchPreferences : Rejected Row Count is " + strconv.Itoa(report.Summary.Rejected))
+	if report.Summary.Rejected != 0 && mode == BATCHATOMIC {
+		logger.Errorf("batchPreferences : Atomic batch rejected, no preference is written")
+		return shim.Error(string(ReportAsBytes))
+	}
+	return shim.Success(ReportAsBytes)
+}
@@ -0,0 +1,443 @@
+/*
+Copyright Tanla Solutions Ltd. 2019 All Rights Reserved.
+Tests of the batch upload against shim.MockStub, and its throughput
+benchmarks run with go test -run NONE -bench Batch
+*/
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/hyperledger/fabric/core/chaincode/shim" // import for Chaincode Interface
+	"github.com/hyperledger/fabric/protos/msp"
+	pb "github.com/hyperledger/fabric/protos/peer" // import for peer response
+)
+
+//testStub is the MockStub of a peer endorsing one transaction at a time. The creator is the identity of an
+//organization, reads see the committed state and the writes of a transaction are committed only when it
+//succeeds, as the writes of a failed proposal never reach the ledger
+type testStub struct {
+	*shim.MockStub
+	creators map[string][]byte
+	creator  []byte
+	function string
+	args     []string
+	now      int64
+	txCount  int
+	writes   map[string][]byte
+	event    *pb.ChaincodeEvent
+}
+
+func (stub *testStub) GetCreator() ([]byte, error) {
+	return stub.creator, nil
+}
+
+func (stub *testStub) GetFunctionAndParameters() (string, []string) {
+	return stub.function, stub.args
+}
+
+func (stub *testStub) GetTxTimestamp() (*timestamp.Timestamp, error) {
+	return &timestamp.Timestamp{Seconds: stub.now}, nil
+}
+
+func (stub *testStub) PutState(key string, value []byte) error {
+	stub.writes[key] = append([]byte{}, value...)
+	return nil
+}
+
+func (stub *testStub) DelState(key string) error {
+	stub.writes[key] = nil
+	return nil
+}
+
+func (stub *testStub) SetEvent(name string, payload []byte) error {
+	stub.event = &pb.ChaincodeEvent{EventName: name, Payload: payload}
+	return nil
+}
+
+//newTestCreator returns the serialized identity of a self signed certificate issued by the organization
+func newTestCreator(tb testing.TB, organization string) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "test", Organization: []string{organization}}, Issuer: pkix.Name{Organization: []string{organization}}, NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour)}
+	certificate, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	identity, err := proto.Marshal(&msp.SerializedIdentity{Mspid: organization + "MSP", IdBytes: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate})})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return identity
+}
+
+//newTestStub returns a stub instantiated with the regulator Trai, the LRN 3333 of svcprv AI registered to Jio
+//and the LRN 4444 of svcprv VI registered to Vodafone
+func newTestStub(tb testing.TB) *testStub {
+	stub := &testStub{MockStub: shim.NewMockStub("cpm", new(CPM)), creators: map[string][]byte{}, now: 1556083755}
+	stub.begin(tb, "Trai", "init", "Trai")
+	stub.commit(new(CPM).Init(stub))
+	for _, lrn := range []string{"{\"lrn\":\"3333\",\"svcprv\":\"AI\",\"lsa\":\"DL\",\"opr\":\"Jio\"}", "{\"lrn\":\"4444\",\"svcprv\":\"VI\",\"lsa\":\"DL\",\"opr\":\"Vodafone\"}"} {
+		if response := stub.invoke(tb, "Trai", "rl", lrn); response.Status != shim.OK {
+			tb.Fatal(response.Message)
+		}
+	}
+	return stub
+}
+
+//begin starts a transaction of the organization calling the function with the arguments
+func (stub *testStub) begin(tb testing.TB, organization string, function string, args ...string) {
+	if _, ok := stub.creators[organization]; !ok {
+		stub.creators[organization] = newTestCreator(tb, organization)
+	}
+	stub.creator = stub.creators[organization]
+	stub.function, stub.args = function, args
+	stub.txCount++
+	stub.writes = map[string][]byte{}
+	stub.event = nil
+	stub.MockTransactionStart("tx" + strconv.Itoa(stub.txCount))
+}
+
+//commit writes the transaction to the state when the response is a success
+func (stub *testStub) commit(response pb.Response) pb.Response {
+	if response.Status == shim.OK {
+		keys := make([]string, 0, len(stub.writes))
+		for key := range stub.writes {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if stub.writes[key] == nil {
+				stub.MockStub.DelState(key)
+			} else {
+				stub.MockStub.PutState(key, stub.writes[key])
+			}
+		}
+	}
+	stub.MockTransactionEnd(stub.TxID)
+	return response
+}
+
+//invoke runs the function as the organization in a transaction of its own
+func (stub *testStub) invoke(tb testing.TB, organization string, function string, args ...string) pb.Response {
+	stub.begin(tb, organization, function, args...)
+	return stub.commit(new(CPM).Invoke(stub))
+}
+
+//committed returns the preference committed for the MSISDN, nil when there is none
+func (stub *testStub) committed(tb testing.TB, msisdn string) *Preference {
+	value := stub.MockStub.State[msisdn]
+	if value == nil {
+		return nil
+	}
+	preference := &Preference{}
+	if err := json.Unmarshal(value, preference); err != nil {
+		tb.Fatal(err)
+	}
+	return preference
+}
+
+//batchReportOf returns the report of a batch response, the message of a rejected atomic batch holds it
+func batchReportOf(tb testing.TB, response pb.Response) BatchReport {
+	ReportAsBytes := response.Payload
+	if response.Status != shim.OK {
+		ReportAsBytes = []byte(response.Message)
+	}
+	report := BatchReport{}
+	if err := json.Unmarshal(ReportAsBytes, &report); err != nil {
+		tb.Fatalf("response is not a batch report : %d %s %s", response.Status, response.Message, string(response.Payload))
+	}
+	return report
+}
+
+//preferenceRow returns the input json of a preference of the MSISDN, the fields given replace the defaults
+func preferenceRow(msisdn string, fields ...string) string {
+	data := map[string]string{"msisdn": msisdn, "svcprv": "AI", "reqno": "1", "rmode": "2", "ctgr": "1,2,3", "cmode": "10,11", "day": "31", "time": "21", "lrn": "3333", "uts": "1556083755", "cts": "1556083755"}
+	for i := 0; i+1 < len(fields); i += 2 {
+		data[fields[i]] = fields[i+1]
+	}
+	RowAsBytes, _ := json.Marshal(data)
+	return string(RowAsBytes)
+}
+
+func TestBatchPreferencesMode(t *testing.T) {
+	invalid := preferenceRow("91995282", "lrn", "x")
+	tests := []struct {
+		name    string
+		args    []string
+		status  int32
+		summary BatchSummary
+		written []string
+	}{
+		{"default mode is besteffort", []string{preferenceRow("9199528288"), invalid}, shim.OK, BatchSummary{Total: 2, Created: 1, Rejected: 1}, []string{"9199528288"}},
+		{"besteffort writes the valid rows", []string{BATCHBESTEFFORT, invalid, preferenceRow("9199528288")}, shim.OK, BatchSummary{Total: 2, Created: 1, Rejected: 1}, []string{"9199528288"}},
+		{"atomic writes a valid batch", []string{BATCHATOMIC, preferenceRow("9199528288"), preferenceRow("9199528289")}, shim.OK, BatchSummary{Total: 2, Created: 2}, []string{"9199528288", "9199528289"}},
+		{"atomic fails on an invalid row", []string{BATCHATOMIC, preferenceRow("9199528288"), invalid}, shim.ERROR, BatchSummary{Total: 2, Created: 1, Rejected: 1}, nil},
+		{"atomic fails on a rejected state check", []string{BATCHATOMIC, preferenceRow("9199528288"), preferenceRow("9199528289", "lrn", "4444")}, shim.ERROR, BatchSummary{Total: 2, Created: 1, Rejected: 1}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stub := newTestStub(t)
+			keys := len(stub.MockStub.State)
+			response := stub.invoke(t, "Jio", "abp", test.args...)
+			if response.Status != test.status {
+				t.Fatalf("status %d, expected %d : %s", response.Status, test.status, response.Message)
+			}
+			if report := batchReportOf(t, response); report.Summary != test.summary {
+				t.Errorf("summary %+v, expected %+v", report.Summary, test.summary)
+			}
+			for _, msisdn := range []string{"9199528288", "9199528289"} {
+				expected := false
+				for _, written := range test.written {
+					expected = expected || written == msisdn
+				}
+				if written := stub.committed(t, msisdn) != nil; written != expected {
+					t.Errorf("MSISDN %s written %v, expected %v", msisdn, written, expected)
+				}
+			}
+			if test.status != shim.OK && len(stub.MockStub.State) != keys {
+				t.Errorf("a failed batch changed the state")
+			}
+		})
+	}
+}
+
+//rowCodes returns the error codes of the rows of the report
+func rowCodes(report BatchReport) []string {
+	codes := make([]string, len(report.Rows))
+	for i, row := range report.Rows {
+		var rowCodes []string
+		for _, rowError := range row.Errors {
+			rowCodes = append(rowCodes, rowError.Code)
+		}
+		codes[i] = strings.Join(rowCodes, ",")
+	}
+	return codes
+}
+
+func TestBatchPreferencesReport(t *testing.T) {
+	stub := newTestStub(t)
+	//9199528201 is changed before the minimum interval and 9199528202 within it
+	for _, setup := range []struct {
+		elapsed      int64
+		organization string
+		function     string
+		args         []string
+	}{
+		{0, "Jio", "abp", []string{preferenceRow("9199528201"), preferenceRow("9199528204")}},
+		{0, "Jio", "bdp", []string{CHURNDISCONNECTION, "9199528204"}},
+		{700000, "Jio", "abp", []string{preferenceRow("9199528202")}},
+		{0, "Vodafone", "abp", []string{preferenceRow("9199528203", "svcprv", "VI", "lrn", "4444")}},
+	} {
+		stub.now = stub.now + setup.elapsed
+		if response := stub.invoke(t, setup.organization, setup.function, setup.args...); response.Status != shim.OK {
+			t.Fatal(response.Message)
+		}
+	}
+	tests := []struct {
+		name    string
+		row     string
+		outcome string
+		codes   string
+	}{
+		{"new MSISDN", preferenceRow("9199528200"), OUTCOMECREATED, ""},
+		{"own MSISDN after the interval", preferenceRow("9199528201", "reqno", "2"), OUTCOMEUPDATED, ""},
+		{"own MSISDN within the interval", preferenceRow("9199528202", "reqno", "2"), OUTCOMEREJECTED, ERRCHANGETOOSOON},
+		{"MSISDN of another operator", preferenceRow("9199528203"), OUTCOMEREJECTED, ERRUNAUTHORIZED},
+		{"churned MSISDN", preferenceRow("9199528204"), OUTCOMEREJECTED, ERRCHURNED},
+		{"invalid json", "{\"msisdn\":", OUTCOMEREJECTED, ERRINVALIDJSON},
+		{"missing field", strings.Replace(preferenceRow("9199528205"), ",\"cts\":\"1556083755\"", "", 1), OUTCOMEREJECTED, ERRMISSINGFIELD},
+		{"unknown field", strings.Replace(preferenceRow("9199528206"), "}", ",\"extra\":\"1\"}", 1), OUTCOMEREJECTED, ERRUNKNOWNFIELD},
+		{"MSISDN not numeric", preferenceRow("91995282ab"), OUTCOMEREJECTED, ERRMSISDNNOTNUMERIC},
+		{"MSISDN too short", preferenceRow("919952"), OUTCOMEREJECTED, ERRMSISDNLENGTH},
+		{"LRN not numeric", preferenceRow("9199528207", "lrn", "x"), OUTCOMEREJECTED, ERRLRNNOTNUMERIC},
+		{"LRN not registered", preferenceRow("9199528208", "lrn", "5555"), OUTCOMEREJECTED, ERRLRNNOTREGISTERED},
+		{"LRN of another operator", preferenceRow("9199528209", "lrn", "4444"), OUTCOMEREJECTED, ERRLRNNOTOWNED},
+	}
+	rows := make([]string, len(tests))
+	expected := BatchSummary{Total: len(tests)}
+	for i, test := range tests {
+		rows[i] = test.row
+		switch test.outcome {
+		case OUTCOMECREATED:
+			expected.Created++
+		case OUTCOMEUPDATED:
+			expected.Updated++
+		case OUTCOMEREJECTED:
+			expected.Rejected++
+		}
+	}
+	report := batchReportOf(t, stub.invoke(t, "Jio", "abp", rows...))
+	if report.Summary != expected {
+		t.Errorf("summary %+v, expected %+v", report.Summary, expected)
+	}
+	if len(report.Rows) != len(tests) {
+		t.Fatalf("%d rows reported, expected %d", len(report.Rows), len(tests))
+	}
+	codes := rowCodes(report)
+	for i, test := range tests {
+		if report.Rows[i].Row != i || report.Rows[i].Outcome != test.outcome || codes[i] != test.codes {
+			t.Errorf("%s : row %d %s %s, expected row %d %s %s", test.name, report.Rows[i].Row, report.Rows[i].Outcome, codes[i], i, test.outcome, test.codes)
+		}
+	}
+}
+
+func TestBatchPreferencesCollapse(t *testing.T) {
+	const msisdn = "9199528288"
+	tests := []struct {
+		name      string
+		rows      []string
+		outcomes  []string
+		codes     []string
+		collapsed []int
+		reqno     string
+	}{
+		{"the last valid row is applied", []string{preferenceRow(msisdn, "reqno", "1"), preferenceRow(msisdn, "reqno", "2")},
+			[]string{OUTCOMESKIPPED, OUTCOMECREATED}, []string{ERRDUPLICATEINBATCH, ""}, []int{1, -1}, "2"},
+		{"a failing correction falls back to the previous row", []string{preferenceRow(msisdn, "reqno", "1"), preferenceRow(msisdn, "reqno", "2", "lrn", "5555")},
+			[]string{OUTCOMECREATED, OUTCOMEREJECTED}, []string{"", ERRLRNNOTREGISTERED}, []int{-1, -1}, "1"},
+		{"the rows before the applied row collapse into it", []string{preferenceRow(msisdn, "reqno", "1"), preferenceRow(msisdn, "reqno", "2"), preferenceRow(msisdn, "reqno", "3", "lrn", "4444")},
+			[]string{OUTCOMESKIPPED, OUTCOMECREATED, OUTCOMEREJECTED}, []string{ERRDUPLICATEINBATCH, "", ERRLRNNOTOWNED}, []int{1, -1, -1}, "2"},
+		{"invalid rows take no part in the collapse", []string{preferenceRow(msisdn, "reqno", "1"), preferenceRow(msisdn, "reqno", "2", "lrn", "x")},
+			[]string{OUTCOMECREATED, OUTCOMEREJECTED}, []string{"", ERRLRNNOTNUMERIC}, []int{-1, -1}, "1"},
+		{"other MSISDNs in between are applied", []string{preferenceRow(msisdn, "reqno", "1"), preferenceRow("9199528289"), preferenceRow(msisdn, "reqno", "2")},
+			[]string{OUTCOMESKIPPED, OUTCOMECREATED, OUTCOMECREATED}, []string{ERRDUPLICATEINBATCH, "", ""}, []int{2, -1, -1}, "2"},
+		{"no row is applied when every row fails", []string{preferenceRow(msisdn, "lrn", "5555"), preferenceRow(msisdn, "lrn", "4444")},
+			[]string{OUTCOMEREJECTED, OUTCOMEREJECTED}, []string{ERRLRNNOTREGISTERED, ERRLRNNOTOWNED}, []int{-1, -1}, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stub := newTestStub(t)
+			report := batchReportOf(t, stub.invoke(t, "Jio", "abp", test.rows...))
+			codes := rowCodes(report)
+			for i, row := range report.Rows {
+				collapsed := -1
+				if row.CollapsedInto != nil {
+					collapsed = *row.CollapsedInto
+				}
+				if row.Outcome != test.outcomes[i] || codes[i] != test.codes[i] || collapsed != test.collapsed[i] {
+					t.Errorf("row %d %s %s collapsed into %d, expected %s %s collapsed into %d", i, row.Outcome, codes[i], collapsed, test.outcomes[i], test.codes[i], test.collapsed[i])
+				}
+			}
+			preference := stub.committed(t, msisdn)
+			if test.reqno == "" && preference != nil {
+				t.Errorf("MSISDN written by reqno %s, expected no write", preference.RequestNumber)
+			}
+			if test.reqno != "" && (preference == nil || preference.RequestNumber != test.reqno) {
+				t.Errorf("MSISDN written %+v, expected reqno %s", preference, test.reqno)
+			}
+		})
+	}
+}
+
+func TestBatchPreferencesCollapseStateCheck(t *testing.T) {
+	stub := newTestStub(t)
+	const msisdn = "9199528203"
+	if response := stub.invoke(t, "Vodafone", "abp", preferenceRow(msisdn, "svcprv", "VI", "lrn", "4444")); response.Status != shim.OK {
+		t.Fatal(response.Message)
+	}
+	report := batchReportOf(t, stub.invoke(t, "Jio", "abp", preferenceRow(msisdn, "reqno", "1"), preferenceRow(msisdn, "reqno", "2")))
+	for i, row := range report.Rows {
+		if row.Outcome != OUTCOMEREJECTED || row.CollapsedInto != nil || rowCodes(report)[i] != ERRUNAUTHORIZED {
+			t.Errorf("row %d %+v, expected rejected %s without collapse", i, row, ERRUNAUTHORIZED)
+		}
+	}
+	if preference := stub.committed(t, msisdn); preference.UpdatedBy != "Vodafone" || preference.RequestNumber != "1" {
+		t.Errorf("MSISDN written %+v, expected the record of Vodafone", preference)
+	}
+}
+
+func TestBatchTooLarge(t *testing.T) {
+	stub := newTestStub(t)
+	if response := stub.invoke(t, "Trai", "scfg", "{\"maxbatch\":2}"); response.Status != shim.OK {
+		t.Fatal(response.Message)
+	}
+	tests := []struct {
+		function string
+		args     []string
+		status   int32
+	}{
+		{"abp", []string{preferenceRow("9199528201"), preferenceRow("9199528202")}, shim.OK},
+		{"abp", []string{BATCHATOMIC, preferenceRow("9199528203"), preferenceRow("9199528204"), preferenceRow("9199528205")}, shim.ERROR},
+		{"bdp", []string{CHURNDISCONNECTION, "9199528201", "9199528202"}, shim.OK},
+		{"bdp", []string{CHURNDISCONNECTION, "9199528201", "9199528202", "9199528203"}, shim.ERROR},
+		{"bpo", []string{portRow("9199528201"), portRow("9199528202")}, shim.OK},
+		{"bpo", []string{portRow("9199528201"), portRow("9199528202"), portRow("9199528203")}, shim.ERROR},
+	}
+	for _, test := range tests {
+		keys := len(stub.MockStub.State)
+		response := stub.invoke(t, "Jio", test.function, test.args...)
+		if response.Status != test.status {
+			t.Errorf("%s of %d arguments status %d, expected %d : %s", test.function, len(test.args), response.Status, test.status, response.Message)
+		}
+		if tooLarge := strings.Contains(response.Message, ERRBATCHTOOLARGE); tooLarge != (test.status != shim.OK) {
+			t.Errorf("%s of %d arguments : %s, expected %s only above maxbatch", test.function, len(test.args), response.Message, ERRBATCHTOOLARGE)
+		}
+		if test.status != shim.OK && len(stub.MockStub.State) != keys {
+			t.Errorf("%s of too many rows changed the state", test.function)
+		}
+	}
+}
+
+//benchPreferenceRows returns the rows of a batch of new preferences
+func benchPreferenceRows(size int) []string {
+	rows := make([]string, size)
+	for i := range rows {
+		rows[i] = preferenceRow("91"+strconv.Itoa(9000000000+i), "reqno", strconv.Itoa(i))
+	}
+	return rows
+}
+
+//BenchmarkBatchPreferences writes batches of new preferences with abp, each batch on an empty ledger.
+//The commit of the writes is left out of the measure, MockStub inserts every committed key into a sorted
+//list so the batches are kept below the maxbatch of a real peer to bound the run time
+func BenchmarkBatchPreferences(b *testing.B) {
+	for _, size := range []int{10, 100, 250} {
+		rows := benchPreferenceRows(size)
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				stub := newTestStub(b)
+				stub.begin(b, "Jio", "abp", rows...)
+				b.StartTimer()
+				response := new(CPM).batchPreferences(stub, rows)
+				b.StopTimer()
+				if stub.commit(response).Status != shim.OK {
+					b.Fatal(response.Message)
+				}
+				b.StartTimer()
+			}
+		})
+	}
+}
+
+//BenchmarkBatchPreferencesValidation rejects batches of invalid rows, measuring the first pass alone
+func BenchmarkBatchPreferencesValidation(b *testing.B) {
+	rows := benchPreferenceRows(1000)
+	for i := range rows {
+		rows[i] = rows[i][:len(rows[i])-1] + ",\"extra\":\"1\"}"
+	}
+	stub := newTestStub(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		stub.begin(b, "Jio", "abp", rows...)
+		stub.commit(new(CPM).batchPreferences(stub, rows))
+	}
+}
@@ -0,0 +1,82 @@
+/*
+Copyright Tanla Solutions Ltd. 2019 All Rights Reserved.
+Single aggregated event of a batch transaction. Only the last
+event of a transaction is delivered, so batch functions publish
+every affected MSISDN in one event, or a digest and a ledger
+pointer when the event would exceed the configured size.
+*/
+
+package main
+
+import (
+	"encoding/json" //reading and writing JSON
+
+	"github.com/beerumicroservice/blockChain/events"    // import for Batch Event payload
+	"github.com/hyperledger/fabric/core/chaincode/shim" // import for Chaincode Interface
+	pb "github.com/hyperledger/fabric/protos/peer"      // import for peer response
+)
+
+//Event Names
+const EVTBATCHPREFERENCES = "BATCH-PREFERENCES"
+
+//Composite Key Object Types
+const KEYBATCHEVENT = "BATCHEVENT"
+
+//newBatchItem builds the event item of an MSISDN with its new record
+func newBatchItem(msisdn string, operation string, record []byte) events.BatchItem {
+	return events.BatchItem{Phone: msisdn, Operation: operation, Record: json.RawMessage(record)}
+}
+
+//publishBatchEvent publishes the items as one event. When the event exceeds the configured
+//size the complete event is stored under a pointer key and only its digest is published
+func publishBatchEvent(stub shim.ChaincodeStubInterface, config *Config, eventName string, items []events.BatchItem) error {
+	if len(items) == 0 {
+		return nil
+	}
+	event := events.BatchEvent{Txid: stub.GetTxID(), Count: len(items), Items: items}
+	EventAsBytes, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if len(EventAsBytes) > config.MaxEventBytes {
+		key, err := stub.CreateCompositeKey(KEYBATCHEVENT, []string{event.Txid})
+		if err != nil {
+			return err
+		}
+		if err := stub.PutState(key, EventAsBytes); err != nil {
+			return err
+		}
+		compact := events.BatchEvent{Txid: event.Txid, Count: event.Count, Digest: events.Digest(EventAsBytes), PointerKey: key}
+		EventAsBytes, err = json.Marshal(compact)
+		if err != nil {
+			return err
+		}
+		logger.Infof("publishBatchEvent : Batch event of " + event.Txid + " is stored under the pointer key")
+	}
+	return publishEvent(stub, eventName, EventAsBytes)
+}
+
+//=====================================================================================
+//queryBatchEvent for retrieving the complete batch event stored for a transaction.
+//Arguments [txid]
+//=====================================================================================
+
+func (dlp *CPM) queryBatchEvent(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("queryBatchEvent : Incorrect number of arguments, Expected 1 [txid]")
+	}
+	key, err := stub.CreateCompositeKey(KEYBATCHEVENT, []string{args[0]})
+	if err != nil {
+		logger.Errorf("queryBatchEvent : Composite Key Creation Error : " + string(err.Error()))
+		return shim.Error("queryBatchEvent : Composite Key Creation Error : " + string(err.Error()))
+	}
+	value, err := stub.GetState(key)
+	if err != nil {
+		logger.Errorf("queryBatchEvent : GetState Failed for Transaction : " + args[0] + " , Error : " + string(err.Error()))
+		return shim.Error("queryBatchEvent : GetState Failed for Transaction : " + args[0] + " , Error : " + string(err.Error()))
+	}
+	if value == nil {
+		return shim.Error("queryBatchEvent : No stored batch event for Transaction : " + args[0])
+	}
+	return shim.Success(value)
+}
@@ -0,0 +1,351 @@
+/*
+Copyright Tanla Solutions Ltd. 2019 All Rights Reserved.
+Churn-out of MSISDNs by the owning operator. A churned preference
+is replaced by a tombstone recording the reason, the churning
+operator and the time. Tombstones are left out of the normal
+queries, retrievable by the audit query and deleted after
+the configured retention, keeping the churn alone.
+*/
+
+package main
+
+import (
+	"encoding/json" //reading and writing JSON
+	"strconv"
+	"strings"
+
+	"github.com/beerumicroservice/blockChain/events"    // import for Batch Event payload
+	"github.com/hyperledger/fabric/core/chaincode/shim" // import for Chaincode Interface
+	pb "github.com/hyperledger/fabric/protos/peer"      // import for peer response
+)
+
+//Event Names
+const EVTBATCHDELPREFERENCES = "BATCH-DELETE-PREFERENCES"
+const EVTPURGEPREFERENCES = "PURGE-PREFERENCES"
+
+//Preference Status of a tombstone
+const PREFCHURNED = "churned"
+
+//Churn Reason codes
+const CHURNDISCONNECTION = "disconnection"
+const CHURNSUBSCRIBER = "subscriber"
+const CHURNPORT = "port"
+
+//Error Codes
+const ERRNOTCHURNED = "NOT_CHURNED"
+const ERRRETENTION = "RETENTION_NOT_ELAPSED"
+
+//churnReasonResp is the error response for an unknown churn reason
+const churnReasonResp = "{\"Error\":\"churn reason shall be disconnection, subscriber or port \"}"
+
+//Tombstone Structure for the churn-out of an MSISDN
+type Tombstone struct {
+	Reason    string `json:"reason"`
+	ChurnedBy string `json:"cby"`
+	ChurnTs   string `json:"chts"`
+}
+
+//isChurnReason checks whether the reason is a known churn reason code
+func isChurnReason(reason string) bool {
+	return reason == CHURNDISCONNECTION || reason == CHURNSUBSCRIBER || reason == CHURNPORT
+}
+
+//isChurnedRecord checks whether the stored value is the tombstone of a churned MSISDN
+func isChurnedRecord(value []byte) bool {
+	if value == nil {
+		return false
+	}
+	record := Preference{}
+	if err := json.Unmarshal(value, &record); err != nil {
+		return false
+	}
+	return record.ObjType == "Preferences" && record.Status == PREFCHURNED && record.Churn != nil
+}
+
+//churnPreference returns the tombstone replacing the churned preference
+func churnPreference(preference *Preference, reason string, organization string, txTime int64) *Preference {
+	tombstone := *preference
+	tombstone.Pending = nil
+	tombstone.Status = PREFCHURNED
+	tombstone.Churn = &Tombstone{Reason: reason, ChurnedBy: organization, ChurnTs: formatTime(txTime)}
+	tombstone.UpdatedBy = organization
+	tombstone.LastChangeTs = formatTime(txTime)
+	return &tombstone
+}
+
+//======================================================
+//batchDelPreferences for replacing the preferences of churned MSISDNs
+//by their tombstones. Arguments [mode?, reason, msisdn, msisdn, ...],
+//the optional mode is atomic or besteffort (default). Every MSISDN is
+//churned only by the operator owning it, as in delPreferences. An MSISDN
+//repeated in the list is checked once at its last row, when it is churned
+//the earlier rows are skipped as collapsed into it and otherwise all of its
+//rows carry the errors of the checks
+//=======================================================
+
+func (dlp *CPM) batchDelPreferences(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	mode := BATCHBESTEFFORT
+	if len(args) > 0 && (args[0] == BATCHATOMIC || args[0] == BATCHBESTEFFORT) {
+		mode = args[0]
+		args = args[1:]
+	}
+	if len(args) < 2 {
+		logger.Errorf("batchDelPreferences : Incorrect Number Of Arguments, Expected atleast 2 [reason, msisdn]")
+		return shim.Error("batchDelPreferences : Incorrect Number Of Arguments, Expected atleast 2 [reason, msisdn]")
+	}
+	reason := args[0]
+	if !isChurnReason(reason) {
+		return shim.Error(churnReasonResp)
+	}
+	msisdns := args[1:]
+	organization, err := getOrganization(stub)
+	if err != nil {
+		logger.Errorf("batchDelPreferences : Getting certificate Details Error : " + string(err.Error()))
+		return shim.Error("batchDelPreferences : Getting certificate Details Error : " + string(err.Error()))
+	}
+	config, err := getConfig(stub)
+	if err != nil {
+		logger.Errorf("batchDelPreferences : GetState Failed for Config Error : " + string(err.Error()))
+		return shim.Error("batchDelPreferences : GetState Failed for Config Error : " + string(err.Error()))
+	}
+	if len(msisdns) > config.MaxBatchSize {
+		logger.Errorf("batchDelPreferences : " + batchTooLargeResp(len(msisdns), config))
+		return shim.Error(batchTooLargeResp(len(msisdns), config))
+	}
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		logger.Errorf("batchDelPreferences : Getting Transaction Timestamp Error : " + string(err.Error()))
+		return shim.Error("batchDelPreferences : Getting Transaction Timestamp Error : " + string(err.Error()))
+	}
+	report := BatchReport{Txid: stub.GetTxID(), Mode: mode, Rows: []RowReport{}}
+	var items []events.BatchItem
+	reports := make([]RowReport, len(msisdns))
+	groups := make(map[string][]int)
+	for i, msisdn := range msisdns {
+		reports[i] = RowReport{Row: i, Phone: msisdn, Outcome: OUTCOMEREJECTED, Errors: validateMsisdn(msisdn)}
+		if len(reports[i].Errors) == 0 {
+			groups[msisdn] = append(groups[msisdn], i)
+		}
+	}
+	//The rows of an MSISDN are resolved together at its last valid row
+	for i, msisdn := range msisdns {
+		group := groups[msisdn]
+		if len(reports[i].Errors) != 0 || group[len(group)-1] != i {
+			continue
+		}
+		value, err := stub.GetState(msisdn)
+		if err != nil {
+			logger.Errorf("batchDelPreferences : GetState Failed for MSISDN : " + msisdn + " , Error : " + string(err.Error()))
+			return shim.Error("batchDelPreferences : GetState Failed for MSISDN : " + msisdn + " , Error : " + string(err.Error()))
+		}
+		if value == nil || isChurnedRecord(value) {
+			logger.Debug("batchDelPreferences : No Existing preferences for MSISDN : " + msisdn)
+			for _, j := range group {
+				reports[j].Outcome = OUTCOMESKIPPED
+				reports[j].Errors = append(reports[j].Errors, RowError{Code: ERRNOTFOUND, Message: "No Existing preferences for MSISDN"})
+			}
+			continue
+		}
+		preference := Preference{}
+		if err := json.Unmarshal(value, &preference); err != nil {
+			logger.Errorf("batchDelPreferences : Unmarshaling Error : " + string(err.Error()))
+			return shim.Error("batchDelPreferences : Unmarshaling Error : " + string(err.Error()))
+		}
+		var stateError *RowError
+		if strings.Compare(preference.UpdatedBy, organization) != 0 {
+			logger.Errorf("batchDelPreferences : Unauthorized Access for MSISDN : " + msisdn)
+			stateError = &RowError{Code: ERRUNAUTHORIZED, Message: "MSISDN is owned by another operator"}
+		} else if reason == CHURNSUBSCRIBER && isChangeTooSoon(&preference, config, txTime) {
+			//Only a deletion asked by the subscriber is held to the minimum interval, as in delPreferences
+			logger.Errorf("batchDelPreferences : " + changeTooSoonResp)
+			stateError = &RowError{Code: ERRCHANGETOOSOON, Message: "Preference is changed within the minimum interval of the previous change"}
+		}
+		if stateError != nil {
+			for _, j := range group {
+				reports[j].Errors = append(reports[j].Errors, *stateError)
+			}
+			continue
+		}
+		tombstone := churnPreference(&preference, reason, organization, txTime)
+		PrfAsBytes, err := json.Marshal(tombstone)
+		if err != nil {
+			logger.Errorf("batchDelPreferences : Marshalling Error : " + string(err.Error()))
+			return shim.Error("batchDelPreferences : Marshalling Error : " + string(err.Error()))
+		}
+		err = stub.PutState(msisdn, PrfAsBytes)
+		if err != nil {
+			logger.Errorf("batchDelPreferences : Removing Preferences from DLT error for MSISDN " + msisdn + " , Error : " + string(err.Error()))
+			return shim.Error("batchDelPreferences : Removing Preferences from DLT error for MSISDN " + msisdn + " , Error : " + string(err.Error()))
+		}
+		err = trackPreferenceWrite(stub, &preference, tombstone)
+		if err != nil {
+			logger.Errorf("batchDelPreferences : Index and Statistics Update Failed for MSISDN : " + msisdn + " , Error : " + string(err.Error()))
+			return shim.Error("batchDelPreferences : Index and Statistics Update Failed for MSISDN : " + msisdn + " , Error : " + string(err.Error()))
+		}
+		item := newBatchItem(msisdn, OUTCOMEDELETED, PrfAsBytes)
+		item.Reason = reason
+		items = append(items, item)
+		collapseRows(reports, group, i)
+		reports[i].Outcome = OUTCOMEDELETED
+	}
+	for _, row := range reports {
+		report.add(row)
+	}
+	err = publishBatchEvent(stub, config, EVTBATCHDELPREFERENCES, items)
+	if err != nil {
+		logger.Errorf("batchDelPreferences : Event Creation Error for EventID : " + string(EVTBATCHDELPREFERENCES) + " , Error : " + string(err.Error()))
+		return shim.Error("batchDelPreferences : Event Creation Error for EventID : " + string(EVTBATCHDELPREFERENCES) + " , Error : " + string(err.Error()))
+	}
+	ReportAsBytes, err := json.Marshal(report)
+	if err != nil {
+		logger.Errorf("batchDelPreferences : Report Marshalling Error : " + string(err.Error()))
+		return shim.Error("batchDelPreferences : Report Marshalling Error : " + string(err.Error()))
+	}
+	logger.Infof("batchDelPreferences : Deleted Count is " + strconv.Itoa(report.Summary.Deleted) + " for reason " + reason)
+	if report.Summary.Rejected != 0 && mode == BATCHATOMIC {
+		logger.Errorf("batchDelPreferences : Atomic batch rejected, no preference is deleted")
+		return shim.Error(string(ReportAsBytes))
+	}
+	return shim.Success(ReportAsBytes)
+}
+
+//=====================================================================================
+//queryChurnedPreferences audit query for the tombstones of churned MSISDNs.
+//Arguments [msisdn, msisdn, ...], up to the configured maxbatch MSISDNs, MSISDNs without
+//a tombstone are left out. The response is bounded by the arguments and is not paged
+//=====================================================================================
+
+func (dlp *CPM) queryChurnedPreferences(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) == 0 {
+		return shim.Error("queryChurnedPreferences : Incorrect number of arguments, Expected atleast 1 [msisdn]")
+	}
+	config, err := getConfig(stub)
+	if err != nil {
+		logger.Errorf("queryChurnedPreferences : GetState Failed for Config Error : " + string(err.Error()))
+		return shim.Error("queryChurnedPreferences : GetState Failed for Config Error : " + string(err.Error()))
+	}
+	if len(args) > config.MaxBatchSize {
+		logger.Errorf("queryChurnedPreferences : " + batchTooLargeResp(len(args), config))
+		return shim.Error(batchTooLargeResp(len(args), config))
+	}
+	tombstones := []*Preference{}
+	for _, msisdn := range args {
+		value, err := stub.GetState(msisdn)
+		if err != nil {
+			logger.Errorf("queryChurnedPreferences : GetState Failed for MSISDN : " + msisdn + " , Error : " + string(err.Error()))
+			return shim.Error("queryChurnedPreferences : GetState Failed for MSISDN : " + msisdn + " , Error : " + string(err.Error()))
+		}
+		if !isChurnedRecord(value) {
+			continue
+		}
+		tombstone := &Preference{}
+		if err := json.Unmarshal(value, tombstone); err != nil {
+			logger.Errorf("queryChurnedPreferences : Unmarshaling Error : " + string(err.Error()))
+			return shim.Error("queryChurnedPreferences : Unmarshaling Error : " + string(err.Error()))
+		}
+		tombstones = append(tombstones, tombstone)
+	}
+	TombstonesAsBytes, err := json.Marshal(tombstones)
+	if err != nil {
+		logger.Errorf("queryChurnedPreferences : Marshalling Error : " + string(err.Error()))
+		return shim.Error("queryChurnedPreferences : Marshalling Error : " + string(err.Error()))
+	}
+	return shim.Success(TombstonesAsBytes)
+}
+
+//=====================================================================================
+//purgePreferences deletes the tombstones whose retention is over. The churn alone is
+//kept under its own key, so a purged MSISDN is reused only through reallocateNumber.
+//Arguments [msisdn, msisdn, ...], a tombstone is purged by the churning operator
+//or the regulator. The purged MSISDNs are published in a single PURGE-PREFERENCES event
+//=====================================================================================
+
+func (dlp *CPM) purgePreferences(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) == 0 {
+		return shim.Error("purgePreferences : Incorrect number of arguments, Expected atleast 1 [msisdn]")
+	}
+	organization, err := getOrganization(stub)
+	if err != nil {
+		logger.Errorf("purgePreferences : Getting certificate Details Error : " + string(err.Error()))
+		return shim.Error("purgePreferences : Getting certificate Details Error : " + string(err.Error()))
+	}
+	config, err := getConfig(stub)
+	if err != nil {
+		logger.Errorf("purgePreferences : GetState Failed for Config Error : " + string(err.Error()))
+		return shim.Error("purgePreferences : GetState Failed for Config Error : " + string(err.Error()))
+	}
+	if len(args) > config.MaxBatchSize {
+		logger.Errorf("purgePreferences : " + batchTooLargeResp(len(args), config))
+		return shim.Error(batchTooLargeResp(len(args), config))
+	}
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		logger.Errorf("purgePreferences : Getting Transaction Timestamp Error : " + string(err.Error()))
+		return shim.Error("purgePreferences : Getting Transaction Timestamp Error : " + string(err.Error()))
+	}
+	report := BatchReport{Txid: stub.GetTxID(), Mode: BATCHBESTEFFORT, Rows: []RowReport{}}
+	var items []events.BatchItem
+	purged := make(map[string]bool)
+	for i, msisdn := range args {
+		row := RowReport{Row: i, Phone: msisdn, Outcome: OUTCOMEREJECTED}
+		if purged[msisdn] {
+			row.Outcome = OUTCOMESKIPPED
+			row.Errors = append(row.Errors, RowError{Code: ERRDUPLICATEINBATCH, Message: "MSISDN is repeated in the batch"})
+			report.add(row)
+			continue
+		}
+		value, err := stub.GetState(msisdn)
+		if err != nil {
+			logger.Errorf("purgePreferences : GetState Failed for MSISDN : " + msisdn + " , Error : " + string(err.Error()))
+			return shim.Error("purgePreferences : GetState Failed for MSISDN : " + msisdn + " , Error : " + string(err.Error()))
+		}
+		if !isChurnedRecord(value) {
+			row.Errors = append(row.Errors, RowError{Code: ERRNOTCHURNED, Message: "MSISDN has no tombstone"})
+			report.add(row)
+			continue
+		}
+		tombstone := Preference{}
+		if err := json.Unmarshal(value, &tombstone); err != nil {
+			logger.Errorf("purgePreferences : Unmarshaling Error : " + string(err.Error()))
+			return shim.Error("purgePreferences : Unmarshaling Error : " + string(err.Error()))
+		}
+		if strings.Compare(tombstone.Churn.ChurnedBy, organization) != 0 && !isRegulator(config, organization) {
+			logger.Errorf("purgePreferences : Unauthorized Access for MSISDN : " + msisdn)
+			row.Errors = append(row.Errors, RowError{Code: ERRUNAUTHORIZED, Message: "MSISDN is churned by another operator"})
+			report.add(row)
+			continue
+		}
+		churnTs, err := parseTime(tombstone.Churn.ChurnTs)
+		if err == nil && txTime < churnTs+config.ChurnRetention {
+			row.Errors = append(row.Errors, RowError{Code: ERRRETENTION, Message: "Tombstone is kept until " + formatTime(churnTs+config.ChurnRetention)})
+			report.add(row)
+			continue
+		}
+		err = stub.DelState(msisdn)
+		if err != nil {
+			logger.Errorf("purgePreferences : Removing Preferences from DLT error for MSISDN " + msisdn + " , Error : " + string(err.Error()))
+			return shim.Error("purgePreferences : Removing Preferences from DLT error for MSISDN " + msisdn + " , Error : " + string(err.Error()))
+		}
+		err = putPurgedChurn(stub, msisdn, tombstone.Churn)
+		if err != nil {
+			logger.Errorf("purgePreferences : PutState Failed for Churn of MSISDN " + msisdn + " , Error : " + string(err.Error()))
+			return shim.Error("purgePreferences : PutState Failed for Churn of MSISDN " + msisdn + " , Error : " + string(err.Error()))
+		}
+		purged[msisdn] = true
+		items = append(items, newBatchItem(msisdn, OUTCOMEDELETED, nil))
+		row.Outcome = OUTCOMEDELETED
+		report.add(row)
+	}
+	err = publishBatchEvent(stub, config, EVTPURGEPREFERENCES, items)
+	if err != nil {
+		logger.Errorf("purgePreferences : Event Creation Error for EventID : " + string(EVTPURGEPREFERENCES) + " , Error : " + string(err.Error()))
+		return shim.Error("purgePreferences : Event Creation Error for EventID : " + string(EVTPURGEPREFERENCES) + " , Error : " + string(err.Error()))
+	}
+	ReportAsBytes, err := json.Marshal(report)
+	if err != nil {
+		logger.Errorf("purgePreferences : Report Marshalling Error : " + string(err.Error()))
+		return shim.Error("purgePreferences : Report Marshalling Error : " + string(err.Error()))
+	}
+	logger.Infof("purgePreferences : Purged Count is " + strconv.Itoa(report.Summary.Deleted))
+	return shim.Success(ReportAsBytes)
+}
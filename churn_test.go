@@ -0,0 +1,114 @@
+/*
+Copyright Tanla Solutions Ltd. 2019 All Rights Reserved.
+Tests of the batch churn-out against shim.MockStub
+*/
+
+package main
+
+import (
+	"testing"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim" // import for Chaincode Interface
+)
+
+//newChurnStub returns a testStub where Jio owns 9199528201 changed before the minimum interval,
+//9199528202 changed within it and Vodafone owns 9199528203
+func newChurnStub(tb testing.TB) *testStub {
+	stub := newTestStub(tb)
+	for _, setup := range []struct {
+		elapsed      int64
+		organization string
+		row          string
+	}{
+		{0, "Jio", preferenceRow("9199528201")},
+		{0, "Vodafone", preferenceRow("9199528203", "svcprv", "VI", "lrn", "4444")},
+		{700000, "Jio", preferenceRow("9199528202")},
+	} {
+		stub.now = stub.now + setup.elapsed
+		if response := stub.invoke(tb, setup.organization, "abp", setup.row); response.Status != shim.OK {
+			tb.Fatal(response.Message)
+		}
+	}
+	return stub
+}
+
+func TestBatchDelPreferences(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		status   int32
+		outcomes []string
+		codes    []string
+		churned  []string
+	}{
+		{"disconnection churns own MSISDNs", []string{CHURNDISCONNECTION, "9199528201", "9199528202"},
+			shim.OK, []string{OUTCOMEDELETED, OUTCOMEDELETED}, []string{"", ""}, []string{"9199528201", "9199528202"}},
+		{"port churns own MSISDNs", []string{CHURNPORT, "9199528202"},
+			shim.OK, []string{OUTCOMEDELETED}, []string{""}, []string{"9199528202"}},
+		{"subscriber is held to the minimum interval", []string{CHURNSUBSCRIBER, "9199528201", "9199528202"},
+			shim.OK, []string{OUTCOMEDELETED, OUTCOMEREJECTED}, []string{"", ERRCHANGETOOSOON}, []string{"9199528201"}},
+		{"MSISDN of another operator", []string{CHURNDISCONNECTION, "9199528203", "9199528201"},
+			shim.OK, []string{OUTCOMEREJECTED, OUTCOMEDELETED}, []string{ERRUNAUTHORIZED, ""}, []string{"9199528201"}},
+		{"MSISDN without preferences", []string{CHURNDISCONNECTION, "9199528209"},
+			shim.OK, []string{OUTCOMESKIPPED}, []string{ERRNOTFOUND}, nil},
+		{"invalid MSISDN", []string{CHURNDISCONNECTION, "919952"},
+			shim.OK, []string{OUTCOMEREJECTED}, []string{ERRMSISDNLENGTH}, nil},
+		{"repeated MSISDN", []string{CHURNDISCONNECTION, "9199528201", "9199528201"},
+			shim.OK, []string{OUTCOMESKIPPED, OUTCOMEDELETED}, []string{ERRDUPLICATEINBATCH, ""}, []string{"9199528201"}},
+		{"atomic writes nothing on a rejected row", []string{BATCHATOMIC, CHURNDISCONNECTION, "9199528201", "9199528203"},
+			shim.ERROR, []string{OUTCOMEDELETED, OUTCOMEREJECTED}, []string{"", ERRUNAUTHORIZED}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stub := newChurnStub(t)
+			keys := len(stub.MockStub.State)
+			response := stub.invoke(t, "Jio", "bdp", test.args...)
+			if response.Status != test.status {
+				t.Fatalf("status %d, expected %d : %s", response.Status, test.status, response.Message)
+			}
+			report := batchReportOf(t, response)
+			if len(report.Rows) != len(test.outcomes) {
+				t.Fatalf("%d rows reported, expected %d", len(report.Rows), len(test.outcomes))
+			}
+			codes := rowCodes(report)
+			for i, row := range report.Rows {
+				if row.Outcome != test.outcomes[i] || codes[i] != test.codes[i] {
+					t.Errorf("row %d %s %s, expected %s %s", i, row.Outcome, codes[i], test.outcomes[i], test.codes[i])
+				}
+			}
+			reason := test.args[0]
+			if reason == BATCHATOMIC {
+				reason = test.args[1]
+			}
+			for _, msisdn := range []string{"9199528201", "9199528202", "9199528203"} {
+				expected := false
+				for _, churned := range test.churned {
+					expected = expected || churned == msisdn
+				}
+				preference := stub.committed(t, msisdn)
+				if churned := preference.Status == PREFCHURNED; churned != expected {
+					t.Errorf("MSISDN %s churned %v, expected %v", msisdn, churned, expected)
+				}
+				if expected && (preference.Churn == nil || preference.Churn.Reason != reason || preference.Churn.ChurnedBy != "Jio") {
+					t.Errorf("MSISDN %s tombstone %+v, expected reason %s by Jio", msisdn, preference.Churn, reason)
+				}
+			}
+			if test.status != shim.OK && len(stub.MockStub.State) != keys {
+				t.Errorf("a failed batch changed the state")
+			}
+		})
+	}
+}
+
+func TestBatchDelPreferencesReason(t *testing.T) {
+	stub := newChurnStub(t)
+	keys := len(stub.MockStub.State)
+	for _, args := range [][]string{{"moved", "9199528201"}, {BATCHATOMIC, "9199528201"}, {CHURNPORT}} {
+		if response := stub.invoke(t, "Jio", "bdp", args...); response.Status != shim.ERROR {
+			t.Errorf("arguments %v status %d, expected %d", args, response.Status, shim.ERROR)
+		}
+	}
+	if len(stub.MockStub.State) != keys || stub.committed(t, "9199528201").Status == PREFCHURNED {
+		t.Errorf("a rejected churn changed the state")
+	}
+}
@@ -0,0 +1,522 @@
+/*
+Copyright Tanla Solutions Ltd. 2019 All Rights Reserved.
+UCC Complaint registration by the terminating operator, with the
+verdict evaluated against the preference effective at the time
+of the unsolicited communication, and the resolution workflow
+of the complaint within the regulatory time limits.
+*/
+
+package main
+
+import (
+	"encoding/json" //reading and writing JSON
+	"errors"
+	"strconv" //import for msisdn validation
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim" // import for Chaincode Interface
+	pb "github.com/hyperledger/fabric/protos/peer"      // import for peer response
+)
+
+//Event Names
+const EVTREGCOMPLAINT = "REGISTER-COMPLAINT"
+const EVTCOMPLAINTSTATE = "COMPLAINT-STATE"
+
+//Composite Key Object Types
+const KEYCOMPLAINT = "COMPLAINT"
+
+//Complaint Verdict values
+const VERDICTVALID = "valid"
+const VERDICTINVALID = "invalid"
+
+//Complaint States
+const COMPLAINTREGISTERED = "registered"
+const COMPLAINTFORWARDED = "forwarded"
+const COMPLAINTINVESTIGATING = "investigating"
+const COMPLAINTACTIONTAKEN = "actiontaken"
+const COMPLAINTCLOSED = "closed"
+
+//Day Types of the preference, the days of the week a communication is consented on
+const DAYWEEKDAY = "31"
+const DAYWEEKEND = "32"
+
+//timeBands are the time bands of the preference, the hours of the day from and to a communication is consented in
+var timeBands = map[string][2]int{"21": {0, 6}, "22": {6, 12}, "23": {12, 18}, "24": {18, 24}}
+
+//communicationZone is the time zone the day type and the time band of a communication are read in
+var communicationZone = time.FixedZone("IST", 5*60*60+30*60)
+
+//Complaint Roles
+const ROLETERMINATING = "terminating"
+const ROLEORIGINATING = "originating"
+const ROLEREGULATOR = "regulator"
+
+//complaintTransitions lists for each state the next states and the roles allowed to move the complaint there
+var complaintTransitions = map[string]map[string][]string{
+	COMPLAINTREGISTERED: {
+		COMPLAINTFORWARDED: {ROLETERMINATING},
+		COMPLAINTCLOSED:    {ROLETERMINATING, ROLEREGULATOR},
+	},
+	COMPLAINTFORWARDED: {
+		COMPLAINTINVESTIGATING: {ROLEORIGINATING},
+		COMPLAINTCLOSED:        {ROLEREGULATOR},
+	},
+	COMPLAINTINVESTIGATING: {
+		COMPLAINTACTIONTAKEN: {ROLEORIGINATING},
+		COMPLAINTCLOSED:      {ROLEREGULATOR},
+	},
+	COMPLAINTACTIONTAKEN: {
+		COMPLAINTCLOSED: {ROLETERMINATING, ROLEREGULATOR},
+	},
+}
+
+//=========================================================================================================
+// Complaint structure. Channel is the communication mode code the complainant received the message on
+//=========================================================================================================
+type Complaint struct {
+	ObjType      string `json:"obj"`
+	ComplaintID  string `json:"cid"`
+	Complainant  string `json:"msisdn"`
+	Sender       string `json:"sender"`
+	CommTs       string `json:"cmts"`
+	Category     string `json:"ctgr"`
+	Channel      string `json:"chnl"`
+	RaisedBy     string `json:"rby"`
+	RegisteredTs string `json:"rts"`
+	Verdict      string `json:"verdict"`
+	Reason       string `json:"reason"`
+	Status       string `json:"status"`
+	OrigOperator string `json:"oap"`
+	StateTs      string `json:"sts"`
+	DueTs        string `json:"due"`
+	Remarks      string `json:"remarks"`
+}
+
+//Transition Structure for the complaint state transition input
+type Transition struct {
+	ComplaintID  string `json:"cid"`
+	Status       string `json:"status"`
+	OrigOperator string `json:"oap"`
+	Remarks      string `json:"remarks"`
+}
+
+//StateChange Structure for the complaint state event payload
+type StateChange struct {
+	ComplaintID string `json:"cid"`
+	Status      string `json:"status"`
+}
+
+//SLAEntry Structure for the complaint SLA query response
+type SLAEntry struct {
+	Complaint *Complaint `json:"complaint"`
+	Breached  bool       `json:"breached"`
+}
+
+//getComplaint reads the complaint, nil is returned when it is not registered
+func getComplaint(stub shim.ChaincodeStubInterface, complaintID string) (*Complaint, error) {
+	key, err := stub.CreateCompositeKey(KEYCOMPLAINT, []string{complaintID})
+	if err != nil {
+		return nil, err
+	}
+	value, err := stub.GetState(key)
+	if err != nil || value == nil {
+		return nil, err
+	}
+	complaint := &Complaint{}
+	if err := json.Unmarshal(value, complaint); err != nil {
+		return nil, err
+	}
+	return complaint, nil
+}
+
+//communicationSlot returns the day type and the time band of the communication time
+func communicationSlot(commTime int64) (string, string) {
+	local := time.Unix(commTime, 0).In(communicationZone)
+	dayType := DAYWEEKDAY
+	if local.Weekday() == time.Saturday || local.Weekday() == time.Sunday {
+		dayType = DAYWEEKEND
+	}
+	timeBand := ""
+	for band, hours := range timeBands {
+		if local.Hour() >= hours[0] && local.Hour() < hours[1] {
+			timeBand = band
+		}
+	}
+	return dayType, timeBand
+}
+
+//evaluateComplaint decides the verdict of the complaint against the preference effective at the communication time,
+//a preference without day types or time bands consents to the communication on any day or at any time
+func evaluateComplaint(complaint *Complaint, preference *Preference, commTime int64) (string, string) {
+	if preference == nil {
+		return VERDICTINVALID, "no preference registered for " + complaint.Complainant + " at the time of communication"
+	}
+	if !containsCode(preference.Category, complaint.Category) {
+		return VERDICTVALID, "category " + complaint.Category + " is not consented in preference ctgr " + preference.Category
+	}
+	if !containsCode(preference.CommunicationMode, complaint.Channel) {
+		return VERDICTVALID, "communication mode " + complaint.Channel + " is not consented in preference cmode " + preference.CommunicationMode
+	}
+	dayType, timeBand := communicationSlot(commTime)
+	if preference.DayType != "" && !containsCode(preference.DayType, dayType) {
+		return VERDICTVALID, "day type " + dayType + " is not consented in preference day " + preference.DayType
+	}
+	if preference.DayTimeBand != "" && !containsCode(preference.DayTimeBand, timeBand) {
+		return VERDICTVALID, "time band " + timeBand + " is not consented in preference time " + preference.DayTimeBand
+	}
+	return VERDICTINVALID, "category " + complaint.Category + ", communication mode " + complaint.Channel + ", day type " + dayType + " and time band " + timeBand + " are consented in the preference"
+}
+
+//=====================================================================================
+//registerComplaint for registering a UCC complaint by the operator owning the MSISDN
+//=====================================================================================
+
+func (dlp *CPM) registerComplaint(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		jsonResp := "{\"cid\":\"value\",\"msisdn\":\"value\",\"sender\":\"value\",\"cmts\":\"value\",\"ctgr\":\"value\",\"chnl\":\"value\"}"
+		logger.Errorf("registerComplaint : Incorrect Number Of Arguments, Expected json structure : " + jsonResp)
+		return shim.Error("registerComplaint : Incorrect Number Of Arguments, Expected json structure : " + jsonResp)
+	}
+	input := Complaint{}
+	if err := json.Unmarshal([]byte(args[0]), &input); err != nil {
+		logger.Errorf("registerComplaint : Input arguments unmarhsaling Error : " + string(err.Error()))
+		return shim.Error("registerComplaint : Input arguments unmarhsaling Error : " + string(err.Error()))
+	}
+	if input.ComplaintID == "" || input.Sender == "" || input.Category == "" || input.Channel == "" {
+		return shim.Error("{\"Error\":\"cid, sender, ctgr and chnl are mandatory \"}")
+	}
+	if _, err := strconv.Atoi(input.Complainant); err != nil {
+		return shim.Error("{\"Error\":\"MSISDN is not numeric \"}")
+	}
+	if len(input.Complainant) < 10 {
+		return shim.Error("{\"Error\":\"MSISDN is not a valid length \"}")
+	}
+	commTime, err := parseTime(input.CommTs)
+	if err != nil {
+		return shim.Error("{\"Error\":\"cmts is not numeric \"}")
+	}
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		logger.Errorf("registerComplaint : Getting Transaction Timestamp Error : " + string(err.Error()))
+		return shim.Error("registerComplaint : Getting Transaction Timestamp Error : " + string(err.Error()))
+	}
+	if commTime > txTime {
+		return shim.Error("{\"Error\":\"cmts is later than the registration time \"}")
+	}
+	organization, err := getOrganization(stub)
+	if err != nil {
+		logger.Errorf("registerComplaint : Getting certificate Details Error : " + string(err.Error()))
+		return shim.Error("registerComplaint : Getting certificate Details Error : " + string(err.Error()))
+	}
+	existing, err := getComplaint(stub, input.ComplaintID)
+	if err != nil {
+		logger.Errorf("registerComplaint : GetState Failed for Complaint : " + input.ComplaintID + " , Error : " + string(err.Error()))
+		return shim.Error("registerComplaint : GetState Failed for Complaint : " + input.ComplaintID + " , Error : " + string(err.Error()))
+	}
+	if existing != nil {
+		return shim.Error("registerComplaint : Complaint is already registered : " + input.ComplaintID)
+	}
+	value, err := stub.GetState(input.Complainant)
+	if err != nil {
+		logger.Errorf("registerComplaint : GetState Failed for MSISDN : " + input.Complainant + " , Error : " + string(err.Error()))
+		return shim.Error("registerComplaint : GetState Failed for MSISDN : " + input.Complainant + " , Error : " + string(err.Error()))
+	}
+	if value == nil {
+		return shim.Error("registerComplaint : No Existing preferences for MSISDN : " + input.Complainant + " , Owning operator is unknown")
+	}
+	//The operator that churned the MSISDN is not its owner any more
+	if isChurnedRecord(value) {
+		return shim.Error("registerComplaint : MSISDN is churned : " + input.Complainant + " , Owning operator is unknown")
+	}
+	current := Preference{}
+	if err := json.Unmarshal(value, &current); err != nil {
+		logger.Errorf("registerComplaint : Existing prefernce data Unmarhsaling Error : " + string(err.Error()))
+		return shim.Error("registerComplaint : Existing prefernce data Unmarhsaling Error : " + string(err.Error()))
+	}
+	if strings.Compare(current.UpdatedBy, organization) != 0 {
+		logger.Errorf("Unauthorized Access")
+		return shim.Error("Unauthorized Access")
+	}
+	preference, err := getPreferenceAt(stub, input.Complainant, commTime)
+	if err != nil {
+		logger.Errorf("registerComplaint : Preference History Failed for MSISDN : " + input.Complainant + " , Error : " + string(err.Error()))
+		return shim.Error("registerComplaint : Preference History Failed for MSISDN : " + input.Complainant + " , Error : " + string(err.Error()))
+	}
+	CmpStruct := &Complaint{}
+	CmpStruct.ObjType = "Complaint"
+	CmpStruct.ComplaintID = input.ComplaintID
+	CmpStruct.Complainant = input.Complainant
+	CmpStruct.Sender = input.Sender
+	CmpStruct.CommTs = input.CommTs
+	CmpStruct.Category = input.Category
+	CmpStruct.Channel = input.Channel
+	CmpStruct.RaisedBy = organization
+	CmpStruct.RegisteredTs = formatTime(txTime)
+	CmpStruct.Verdict, CmpStruct.Reason = evaluateComplaint(CmpStruct, preference, commTime)
+	config, err := getConfig(stub)
+	if err != nil {
+		logger.Errorf("registerComplaint : GetState Failed for Config Error : " + string(err.Error()))
+		return shim.Error("registerComplaint : GetState Failed for Config Error : " + string(err.Error()))
+	}
+	setComplaintState(CmpStruct, config, COMPLAINTREGISTERED, txTime)
+	CmpAsBytes, err := json.Marshal(CmpStruct)
+	if err != nil {
+		logger.Errorf("registerComplaint : Marshalling Error : " + string(err.Error()))
+		return shim.Error("registerComplaint : Marshalling Error : " + string(err.Error()))
+	}
+	key, err := stub.CreateCompositeKey(KEYCOMPLAINT, []string{CmpStruct.ComplaintID})
+	if err != nil {
+		logger.Errorf("registerComplaint : Composite Key Creation Error : " + string(err.Error()))
+		return shim.Error("registerComplaint : Composite Key Creation Error : " + string(err.Error()))
+	}
+	err = stub.PutState(key, CmpAsBytes)
+	if err != nil {
+		logger.Errorf("registerComplaint : PutState Failed Error : " + string(err.Error()))
+		return shim.Error("registerComplaint : PutState Failed Error : " + string(err.Error()))
+	}
+	//Only the last event of a transaction is delivered, so a sender status change
+	//is published in place of the registration event and carries the complaint
+	eventName := EVTREGCOMPLAINT
+	eventData := CmpAsBytes
+	if CmpStruct.Verdict == VERDICTVALID {
+		sender, changed, err := countSenderComplaint(stub, config, CmpStruct, txTime)
+		if err != nil {
+			logger.Errorf("registerComplaint : Sender Tally Failed for Sender : " + CmpStruct.Sender + " , Error : " + string(err.Error()))
+			return shim.Error("registerComplaint : Sender Tally Failed for Sender : " + CmpStruct.Sender + " , Error : " + string(err.Error()))
+		}
+		if changed {
+			eventName = EVTSENDERSTATUS
+			eventData, err = json.Marshal(SenderStatusChange{Sender: sender, Complaint: CmpStruct})
+			if err != nil {
+				logger.Errorf("registerComplaint : Event Payload Marshalling Error : " + string(err.Error()))
+				return shim.Error("registerComplaint : Event Payload Marshalling Error : " + string(err.Error()))
+			}
+			logger.Infof("registerComplaint : Sender " + sender.Sender + " moved to status " + sender.Status)
+		}
+	}
+	err = publishEvent(stub, eventName, eventData)
+	if err != nil {
+		logger.Errorf("registerComplaint : Event Creation Error for EventID : " + string(eventName))
+		return shim.Error("registerComplaint : Event Creation Error for EventID : " + string(eventName))
+	}
+	logger.Infof("registerComplaint : PutState Success : " + string(CmpAsBytes))
+	return shim.Success(CmpAsBytes)
+}
+
+//setComplaintState moves the complaint to the state and computes the deadline to leave it
+func setComplaintState(complaint *Complaint, config *Config, state string, txTime int64) {
+	complaint.Status = state
+	complaint.StateTs = formatTime(txTime)
+	complaint.DueTs = ""
+	if seconds, ok := config.ComplaintSLA[state]; ok && state != COMPLAINTCLOSED {
+		complaint.DueTs = formatTime(txTime + seconds)
+	}
+}
+
+//complaintRoles returns the roles the organization holds for the complaint
+func complaintRoles(complaint *Complaint, config *Config, organization string) []string {
+	var roles []string
+	if strings.Compare(complaint.RaisedBy, organization) == 0 {
+		roles = append(roles, ROLETERMINATING)
+	}
+	if strings.Compare(complaint.OrigOperator, organization) == 0 {
+		roles = append(roles, ROLEORIGINATING)
+	}
+	if isRegulator(config, organization) {
+		roles = append(roles, ROLEREGULATOR)
+	}
+	return roles
+}
+
+//=====================================================================================
+//transitComplaint for moving a complaint to its next state by the allowed role
+//=====================================================================================
+
+func (dlp *CPM) transitComplaint(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		jsonResp := "{\"cid\":\"value\",\"status\":\"value\",\"oap\":\"value\",\"remarks\":\"value\"}"
+		logger.Errorf("transitComplaint : Incorrect Number Of Arguments, Expected json structure : " + jsonResp)
+		return shim.Error("transitComplaint : Incorrect Number Of Arguments, Expected json structure : " + jsonResp)
+	}
+	input := Transition{}
+	if err := json.Unmarshal([]byte(args[0]), &input); err != nil {
+		logger.Errorf("transitComplaint : Input arguments unmarhsaling Error : " + string(err.Error()))
+		return shim.Error("transitComplaint : Input arguments unmarhsaling Error : " + string(err.Error()))
+	}
+	complaint, err := getComplaint(stub, input.ComplaintID)
+	if err != nil {
+		logger.Errorf("transitComplaint : GetState Failed for Complaint : " + input.ComplaintID + " , Error : " + string(err.Error()))
+		return shim.Error("transitComplaint : GetState Failed for Complaint : " + input.ComplaintID + " , Error : " + string(err.Error()))
+	}
+	if complaint == nil {
+		return shim.Error("transitComplaint : Complaint is not registered : " + input.ComplaintID)
+	}
+	allowedRoles, ok := complaintTransitions[complaint.Status][input.Status]
+	if !ok {
+		return shim.Error("transitComplaint : Transition from " + complaint.Status + " to " + input.Status + " is not allowed")
+	}
+	if input.Status == COMPLAINTFORWARDED && input.OrigOperator == "" {
+		return shim.Error("{\"Error\":\"oap is mandatory to forward the complaint \"}")
+	}
+	config, err := getConfig(stub)
+	if err != nil {
+		logger.Errorf("transitComplaint : GetState Failed for Config Error : " + string(err.Error()))
+		return shim.Error("transitComplaint : GetState Failed for Config Error : " + string(err.Error()))
+	}
+	organization, err := getOrganization(stub)
+	if err != nil {
+		logger.Errorf("transitComplaint : Getting certificate Details Error : " + string(err.Error()))
+		return shim.Error("transitComplaint : Getting certificate Details Error : " + string(err.Error()))
+	}
+	authorized := false
+	for _, role := range complaintRoles(complaint, config, organization) {
+		for _, allowed := range allowedRoles {
+			if role == allowed {
+				authorized = true
+			}
+		}
+	}
+	if !authorized {
+		logger.Errorf("Unauthorized Access")
+		return shim.Error("Unauthorized Access")
+	}
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		logger.Errorf("transitComplaint : Getting Transaction Timestamp Error : " + string(err.Error()))
+		return shim.Error("transitComplaint : Getting Transaction Timestamp Error : " + string(err.Error()))
+	}
+	if input.Status == COMPLAINTFORWARDED {
+		complaint.OrigOperator = input.OrigOperator
+	}
+	complaint.Remarks = input.Remarks
+	setComplaintState(complaint, config, input.Status, txTime)
+	CmpAsBytes, err := json.Marshal(complaint)
+	if err != nil {
+		logger.Errorf("transitComplaint : Marshalling Error : " + string(err.Error()))
+		return shim.Error("transitComplaint : Marshalling Error : " + string(err.Error()))
+	}
+	key, err := stub.CreateCompositeKey(KEYCOMPLAINT, []string{complaint.ComplaintID})
+	if err != nil {
+		logger.Errorf("transitComplaint : Composite Key Creation Error : " + string(err.Error()))
+		return shim.Error("transitComplaint : Composite Key Creation Error : " + string(err.Error()))
+	}
+	err = stub.PutState(key, CmpAsBytes)
+	if err != nil {
+		logger.Errorf("transitComplaint : PutState Failed Error : " + string(err.Error()))
+		return shim.Error("transitComplaint : PutState Failed Error : " + string(err.Error()))
+	}
+	StateAsBytes, err := json.Marshal(StateChange{ComplaintID: complaint.ComplaintID, Status: complaint.Status})
+	if err != nil {
+		logger.Errorf("transitComplaint : Event Payload Marshalling Error : " + string(err.Error()))
+		return shim.Error("transitComplaint : Event Payload Marshalling Error : " + string(err.Error()))
+	}
+	err = publishEvent(stub, EVTCOMPLAINTSTATE, StateAsBytes)
+	if err != nil {
+		logger.Errorf("transitComplaint : Event Creation Error for EventID : " + string(EVTCOMPLAINTSTATE))
+		return shim.Error("transitComplaint : Event Creation Error for EventID : " + string(EVTCOMPLAINTSTATE))
+	}
+	logger.Infof("transitComplaint : PutState Success : " + string(CmpAsBytes))
+	return shim.Success(CmpAsBytes)
+}
+
+//=====================================================================================
+//queryComplaintSLA lists the open complaints of the caller that breached their deadline
+//or breach it within the given seconds. Arguments [seconds], [seconds, bookmark] or
+//[seconds, bookmark, format], the format defaults to a JSON array refused over the
+//configured maxqb, the bookmark continues a json, ndjson or csv response truncated at maxqb
+//=====================================================================================
+
+func (dlp *CPM) queryComplaintSLA(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 1 || len(args) > 3 {
+		return shim.Error("queryComplaintSLA : Incorrect number of arguments, Expected 1 [seconds], 2 [seconds, bookmark] or 3 [seconds, bookmark, format]")
+	}
+	window, err := parseTime(args[0])
+	if err != nil || window < 0 {
+		return shim.Error("{\"Error\":\"seconds is not a positive number \"}")
+	}
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		logger.Errorf("queryComplaintSLA : Getting Transaction Timestamp Error : " + string(err.Error()))
+		return shim.Error("queryComplaintSLA : Getting Transaction Timestamp Error : " + string(err.Error()))
+	}
+	config, err := getConfig(stub)
+	if err != nil {
+		logger.Errorf("queryComplaintSLA : GetState Failed for Config Error : " + string(err.Error()))
+		return shim.Error("queryComplaintSLA : GetState Failed for Config Error : " + string(err.Error()))
+	}
+	organization, err := getOrganization(stub)
+	if err != nil {
+		logger.Errorf("queryComplaintSLA : Getting certificate Details Error : " + string(err.Error()))
+		return shim.Error("queryComplaintSLA : Getting certificate Details Error : " + string(err.Error()))
+	}
+	bookmark, format := "", ""
+	if len(args) > 1 {
+		bookmark = args[1]
+	}
+	if len(args) > 2 {
+		format = args[2]
+	}
+	if format == "" {
+		format = FORMATARRAY
+	}
+	encoder, _, err := newResultEncoder(format, slaColumns, config.MaxQueryBytes, bookmark)
+	if err != nil {
+		return shim.Error("{\"Error\":\"" + err.Error() + " \"}")
+	}
+	queryString := "{\"selector\":{\"obj\":\"Complaint\",\"status\":{\"$ne\":\"" + COMPLAINTCLOSED + "\"},\"due\":{\"$lte\":\"" + formatTime(txTime+window) + "\"}}}"
+	resultsIterator, err := stub.GetQueryResult(queryString)
+	if err != nil {
+		logger.Errorf("queryComplaintSLA : GetQueryResult Failed Error : " + string(err.Error()))
+		return shim.Error("queryComplaintSLA : GetQueryResult Failed Error : " + string(err.Error()))
+	}
+	defer resultsIterator.Close()
+	err = encodeResults(resultsIterator, encoder, func(key string, value []byte) (string, interface{}, error) {
+		complaint := &Complaint{}
+		if err := json.Unmarshal(value, complaint); err != nil {
+			return key, nil, errors.New("Unmarshaling Error : " + string(err.Error()))
+		}
+		if len(complaintRoles(complaint, config, organization)) == 0 {
+			return key, nil, nil
+		}
+		due, err := parseTime(complaint.DueTs)
+		if err != nil {
+			return key, nil, nil
+		}
+		return complaint.ComplaintID, SLAEntry{Complaint: complaint, Breached: due < txTime}, nil
+	})
+	if err != nil {
+		logger.Errorf("queryComplaintSLA : Iterator Error : " + string(err.Error()))
+		return shim.Error("queryComplaintSLA : Iterator Error : " + string(err.Error()))
+	}
+	EntriesAsBytes, err := encoder.finish("")
+	if err != nil {
+		logger.Errorf("queryComplaintSLA : Marshalling Error : " + string(err.Error()))
+		return shim.Error("queryComplaintSLA : Marshalling Error : " + string(err.Error()))
+	}
+	return shim.Success(EntriesAsBytes)
+}
+
+//=====================================================================================
+//queryComplaint for retrieving a complaint by complaint ID
+//=====================================================================================
+
+func (dlp *CPM) queryComplaint(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("queryComplaint : Incorrect number of arguments, Expected 1 [Complaint ID]")
+	}
+	complaint, err := getComplaint(stub, args[0])
+	if err != nil {
+		logger.Errorf("queryComplaint : GetState Failed for Complaint : " + args[0] + " , Error : " + string(err.Error()))
+		return shim.Error("queryComplaint : GetState Failed for Complaint : " + args[0] + " , Error : " + string(err.Error()))
+	}
+	if complaint == nil {
+		return shim.Error("queryComplaint : Complaint is not registered : " + args[0])
+	}
+	CmpAsBytes, err := json.Marshal(complaint)
+	if err != nil {
+		logger.Errorf("queryComplaint : Marshalling Error : " + string(err.Error()))
+		return shim.Error("queryComplaint : Marshalling Error : " + string(err.Error()))
+	}
+	return shim.Success(CmpAsBytes)
+}
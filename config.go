@@ -0,0 +1,207 @@
+/*
+Copyright Tanla Solutions Ltd. 2019 All Rights Reserved.
+Ledger stored configuration of the Preferences chaincode,
+maintained by the regulator organization.
+*/
+
+package main
+
+import (
+	"encoding/json" //reading and writing JSON
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim" // import for Chaincode Interface
+	pb "github.com/hyperledger/fabric/protos/peer"      // import for peer response
+)
+
+//Event Names
+const EVTSETCONFIG = "SET-CONFIG"
+
+//Composite Key Object Types
+const KEYCONFIG = "CONFIG"
+
+//=========================================================================================================
+// Config structure. ComplaintSLA holds the seconds a complaint may stay in a state before the next transition,
+// SenderRules the valid complaint thresholds that move a sender to a status. ProcessingWindow is the seconds
+// after which a preference change takes effect, MinChangeInterval the seconds between changes of an MSISDN,
+// MaxEventBytes the size above which a batch event is published as a digest with a ledger pointer,
+// MaxBatchSize the most rows accepted by a batch function, ChurnRetention the seconds a churn tombstone is kept,
+// Quarantine the seconds after a churn before the MSISDN is reallocated, MaxQueryResults the page size cap of guarded queries,
+// MaxQueryBytes the size at which a query response is truncated
+//=========================================================================================================
+type Config struct {
+	ObjType           string           `json:"obj"`
+	RegulatorOrg      string           `json:"regulator"`
+	ComplaintSLA      map[string]int64 `json:"csla"`
+	SenderRules       []SenderRule     `json:"srules"`
+	ProcessingWindow  int64            `json:"pwin"`
+	MinChangeInterval int64            `json:"minchg"`
+	MaxEventBytes     int              `json:"maxevt"`
+	MaxBatchSize      int              `json:"maxbatch"`
+	ChurnRetention    int64            `json:"cret"`
+	Quarantine        int64            `json:"qtn"`
+	MaxQueryResults   int32            `json:"maxq"`
+	MaxQueryBytes     int              `json:"maxqb"`
+	UpdatedBy         string           `json:"uby"`
+	UpdateTs          string           `json:"uts"`
+}
+
+//defaultConfig returns the configuration used until the regulator stores one
+func defaultConfig() *Config {
+	return &Config{
+		ObjType: "Config",
+		ComplaintSLA: map[string]int64{
+			COMPLAINTREGISTERED:    86400,
+			COMPLAINTFORWARDED:     86400,
+			COMPLAINTINVESTIGATING: 172800,
+			COMPLAINTACTIONTAKEN:   86400,
+		},
+		SenderRules: []SenderRule{
+			{Status: SENDERWARNED, Count: 3, Days: 7},
+			{Status: SENDERCAPPED, Count: 5, Days: 7},
+			{Status: SENDERBLACKLISTED, Count: 10, Days: 30},
+		},
+		ProcessingWindow:  86400,
+		MinChangeInterval: 604800,
+		MaxEventBytes:     65536,
+		MaxBatchSize:      1000,
+		ChurnRetention:    7776000,
+		Quarantine:        7776000,
+		MaxQueryResults:   200,
+		MaxQueryBytes:     1048576,
+	}
+}
+
+//getConfig reads the configuration, the defaults are filled for the values that are not stored
+func getConfig(stub shim.ChaincodeStubInterface) (*Config, error) {
+	config := defaultConfig()
+	key, err := stub.CreateCompositeKey(KEYCONFIG, []string{"cpm"})
+	if err != nil {
+		return nil, err
+	}
+	value, err := stub.GetState(key)
+	if err != nil || value == nil {
+		return config, err
+	}
+	if err := json.Unmarshal(value, config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+//putConfig stores the configuration
+func putConfig(stub shim.ChaincodeStubInterface, config *Config) ([]byte, error) {
+	config.ObjType = "Config"
+	key, err := stub.CreateCompositeKey(KEYCONFIG, []string{"cpm"})
+	if err != nil {
+		return nil, err
+	}
+	ConfigAsBytes, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	return ConfigAsBytes, stub.PutState(key, ConfigAsBytes)
+}
+
+//isRegulator checks whether the organization is the configured regulator
+func isRegulator(config *Config, organization string) bool {
+	return config.RegulatorOrg != "" && strings.Compare(config.RegulatorOrg, organization) == 0
+}
+
+//callerIsRegulator checks whether the caller organization is the configured regulator
+func callerIsRegulator(stub shim.ChaincodeStubInterface) (bool, error) {
+	config, err := getConfig(stub)
+	if err != nil {
+		return false, err
+	}
+	organization, err := getOrganization(stub)
+	if err != nil {
+		return false, err
+	}
+	return isRegulator(config, organization), nil
+}
+
+//=====================================================================================
+//setConfig for updating the chaincode configuration by the regulator
+//=====================================================================================
+
+func (dlp *CPM) setConfig(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		logger.Errorf("setConfig : Incorrect Number Of Arguments, Expected 1 [Config json]")
+		return shim.Error("setConfig : Incorrect Number Of Arguments, Expected 1 [Config json]")
+	}
+	config, err := getConfig(stub)
+	if err != nil {
+		logger.Errorf("setConfig : GetState Failed for Config Error : " + string(err.Error()))
+		return shim.Error("setConfig : GetState Failed for Config Error : " + string(err.Error()))
+	}
+	organization, err := getOrganization(stub)
+	if err != nil {
+		logger.Errorf("setConfig : Getting certificate Details Error : " + string(err.Error()))
+		return shim.Error("setConfig : Getting certificate Details Error : " + string(err.Error()))
+	}
+	if !isRegulator(config, organization) {
+		logger.Errorf("Unauthorized Access")
+		return shim.Error("Unauthorized Access")
+	}
+	if err := json.Unmarshal([]byte(args[0]), config); err != nil {
+		logger.Errorf("setConfig : Input arguments unmarhsaling Error : " + string(err.Error()))
+		return shim.Error("setConfig : Input arguments unmarhsaling Error : " + string(err.Error()))
+	}
+	if config.RegulatorOrg == "" {
+		return shim.Error("{\"Error\":\"regulator shall not be empty \"}")
+	}
+	for state, seconds := range config.ComplaintSLA {
+		if seconds <= 0 {
+			return shim.Error("{\"Error\":\"csla for " + state + " shall be positive \"}")
+		}
+	}
+	for _, rule := range config.SenderRules {
+		if senderSeverity(rule.Status) == 0 || rule.Count <= 0 || rule.Days <= 0 {
+			return shim.Error("{\"Error\":\"srules shall have status warned, capped or blacklisted with positive count and days \"}")
+		}
+	}
+	if config.ProcessingWindow < 0 || config.MinChangeInterval < 0 || config.ChurnRetention < 0 || config.Quarantine < 0 {
+		return shim.Error("{\"Error\":\"pwin, minchg, cret and qtn shall not be negative \"}")
+	}
+	if config.MaxEventBytes <= 0 || config.MaxBatchSize <= 0 || config.MaxQueryResults <= 0 || config.MaxQueryBytes <= 0 {
+		return shim.Error("{\"Error\":\"maxevt, maxbatch, maxq and maxqb shall be positive \"}")
+	}
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		logger.Errorf("setConfig : Getting Transaction Timestamp Error : " + string(err.Error()))
+		return shim.Error("setConfig : Getting Transaction Timestamp Error : " + string(err.Error()))
+	}
+	config.UpdatedBy = organization
+	config.UpdateTs = formatTime(txTime)
+	ConfigAsBytes, err := putConfig(stub, config)
+	if err != nil {
+		logger.Errorf("setConfig : PutState Failed Error : " + string(err.Error()))
+		return shim.Error("setConfig : PutState Failed Error : " + string(err.Error()))
+	}
+	err = publishEvent(stub, EVTSETCONFIG, ConfigAsBytes)
+	if err != nil {
+		logger.Errorf("setConfig : Event Creation Error for EventID : " + string(EVTSETCONFIG))
+		return shim.Error("setConfig : Event Creation Error for EventID : " + string(EVTSETCONFIG))
+	}
+	logger.Infof("setConfig : PutState Success : " + string(ConfigAsBytes))
+	return shim.Success(ConfigAsBytes)
+}
+
+//=====================================================================================
+//getConfiguration for retrieving the chaincode configuration
+//=====================================================================================
+
+func (dlp *CPM) getConfiguration(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	config, err := getConfig(stub)
+	if err != nil {
+		logger.Errorf("getConfiguration : GetState Failed for Config Error : " + string(err.Error()))
+		return shim.Error("getConfiguration : GetState Failed for Config Error : " + string(err.Error()))
+	}
+	ConfigAsBytes, err := json.Marshal(config)
+	if err != nil {
+		logger.Errorf("getConfiguration : Marshalling Error : " + string(err.Error()))
+		return shim.Error("getConfiguration : Marshalling Error : " + string(err.Error()))
+	}
+	return shim.Success(ConfigAsBytes)
+}
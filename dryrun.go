@@ -0,0 +1,84 @@
+/*
+Copyright Tanla Solutions Ltd. 2019 All Rights Reserved.
+Dry-run validation of the write functions. The function runs
+with all its checks on a stub that discards the writes and
+events, and the would-be outcome is returned. The dry runs are
+only to be evaluated as queries. The chaincode cannot tell an
+evaluation from a submission, so a submitted dry run is ordered
+as a transaction with an empty write set that changes nothing.
+*/
+
+package main
+
+import (
+	"encoding/json" //reading and writing JSON
+
+	"github.com/hyperledger/fabric/core/chaincode/shim" // import for Chaincode Interface
+	pb "github.com/hyperledger/fabric/protos/peer"      // import for peer response
+)
+
+//dryRunStub passes reads to the transaction stub and discards the writes and events
+type dryRunStub struct {
+	shim.ChaincodeStubInterface
+}
+
+//PutState discards the write
+func (stub *dryRunStub) PutState(key string, value []byte) error {
+	return nil
+}
+
+//DelState discards the delete
+func (stub *dryRunStub) DelState(key string) error {
+	return nil
+}
+
+//SetEvent discards the event
+func (stub *dryRunStub) SetEvent(name string, payload []byte) error {
+	return nil
+}
+
+//DryRun Structure for the would-be outcome of a write function, Outcome is the
+//response the function would return, or its error when Valid is false
+type DryRun struct {
+	Function string          `json:"fn"`
+	Valid    bool            `json:"valid"`
+	Outcome  json.RawMessage `json:"outcome"`
+}
+
+//=====================================================================================
+//dryRun runs the write function without writing anything and returns its would-be outcome.
+//The arguments are those of the write function. Evaluate it only, never submit it
+//=====================================================================================
+
+func (dlp *CPM) dryRun(stub shim.ChaincodeStubInterface, function string, args []string) pb.Response {
+	var response pb.Response
+	switch function {
+	case "sp":
+		response = dlp.setPreferences(&dryRunStub{stub}, args)
+	case "abp":
+		response = dlp.batchPreferences(&dryRunStub{stub}, args)
+	case "dp":
+		response = dlp.delPreferences(&dryRunStub{stub}, args)
+	case "po":
+		response = dlp.portOut(&dryRunStub{stub}, args)
+	default:
+		return shim.Error("dryRun : No dry run for Function : " + function)
+	}
+	result := DryRun{Function: function, Valid: response.Status == shim.OK}
+	outcome := response.Payload
+	if !result.Valid {
+		outcome = []byte(response.Message)
+	}
+	if json.Valid(outcome) {
+		result.Outcome = outcome
+	} else {
+		result.Outcome, _ = json.Marshal(string(outcome))
+	}
+	ResultAsBytes, err := json.Marshal(result)
+	if err != nil {
+		logger.Errorf("dryRun : Marshalling Error : " + string(err.Error()))
+		return shim.Error("dryRun : Marshalling Error : " + string(err.Error()))
+	}
+	logger.Infof("dryRun : Outcome of " + function + " : " + string(ResultAsBytes))
+	return shim.Success(ResultAsBytes)
+}
@@ -0,0 +1,64 @@
+/*
+Copyright Tanla Solutions Ltd. 2019 All Rights Reserved.
+Tests of the dry-run validation against shim.MockStub
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim" // import for Chaincode Interface
+)
+
+func TestDryRun(t *testing.T) {
+	tests := []struct {
+		name     string
+		function string
+		args     []string
+		valid    bool
+	}{
+		{"new preference", "vsp", []string{preferenceRow("9199528202")}, true},
+		{"preference of an unregistered LRN", "vsp", []string{preferenceRow("9199528202", "lrn", "5555")}, false},
+		{"batch of preferences", "vabp", []string{preferenceRow("9199528202"), preferenceRow("9199528203")}, true},
+		{"delete of own MSISDN", "vdp", []string{"9199528201"}, true},
+		{"port to the recipient LRN", "vpo", []string{"9199528201", "VI", "4444", "1556083755"}, true},
+		{"port without the update time", "vpo", []string{"9199528201", "VI", "4444"}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stub := newTestStub(t)
+			if response := stub.invoke(t, "Jio", "abp", preferenceRow("9199528201")); response.Status != shim.OK {
+				t.Fatal(response.Message)
+			}
+			state := make(map[string][]byte, len(stub.MockStub.State))
+			for key, value := range stub.MockStub.State {
+				state[key] = value
+			}
+			response := stub.invoke(t, "Jio", test.function, test.args...)
+			if response.Status != shim.OK {
+				t.Fatalf("status %d : %s", response.Status, response.Message)
+			}
+			result := DryRun{}
+			if err := json.Unmarshal(response.Payload, &result); err != nil {
+				t.Fatalf("response is not a dry run : %s", string(response.Payload))
+			}
+			if result.Function != test.function[1:] || result.Valid != test.valid {
+				t.Errorf("dry run of %s valid %v, expected %s %v : %s", result.Function, result.Valid, test.function[1:], test.valid, string(result.Outcome))
+			}
+			if len(stub.writes) != 0 || stub.event != nil {
+				t.Errorf("dry run wrote %d keys and event %v", len(stub.writes), stub.event)
+			}
+			if len(stub.MockStub.State) != len(state) {
+				t.Fatalf("dry run changed the state from %d to %d keys", len(state), len(stub.MockStub.State))
+			}
+			for key, value := range state {
+				if !bytes.Equal(stub.MockStub.State[key], value) {
+					t.Errorf("dry run changed the key %q", key)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,181 @@
+/*
+Copyright Tanla Solutions Ltd. 2019 All Rights Reserved.
+Effective-from handling of preference changes. A change takes
+effect after the processing window, a stored record holds the
+current and the pending preference, and changes of an MSISDN
+are rejected within the minimum interval of the previous one.
+*/
+
+package main
+
+import (
+	"encoding/json" //reading and writing JSON
+
+	"github.com/hyperledger/fabric/core/chaincode/shim" // import for Chaincode Interface
+	pb "github.com/hyperledger/fabric/protos/peer"      // import for peer response
+)
+
+//Error Codes
+const ERRCHANGETOOSOON = "PREF_CHANGE_TOO_SOON"
+
+//changeTooSoonResp is the error response for a change within the minimum interval
+const changeTooSoonResp = "{\"Error\":\"Preference is changed within the minimum interval of the previous change \",\"Code\":\"" + ERRCHANGETOOSOON + "\"}"
+
+//isEffective checks whether the preference is in effect at the given time, records stored
+//before effective-from handling have no effective time and are always in effect
+func isEffective(preference *Preference, at int64) bool {
+	if preference.EffectiveFrom == "" {
+		return true
+	}
+	effectiveFrom, err := parseTime(preference.EffectiveFrom)
+	return err == nil && effectiveFrom <= at
+}
+
+//promotePreference returns the record with the pending preference made current once it is in effect
+func promotePreference(preference *Preference, at int64) *Preference {
+	if preference.Pending == nil || !isEffective(preference.Pending, at) {
+		return preference
+	}
+	current := *preference.Pending
+	current.Pending = nil
+	current.LastChangeTs = preference.LastChangeTs
+	return &current
+}
+
+//effectivePreference returns the preference in effect at the given time without the pending
+//preference, nil is returned when no preference is in effect yet or the MSISDN is churned
+func effectivePreference(preference *Preference, at int64) *Preference {
+	if preference == nil || preference.Status == PREFCHURNED {
+		return nil
+	}
+	preference = promotePreference(preference, at)
+	if !isEffective(preference, at) {
+		return nil
+	}
+	effective := *preference
+	effective.Pending = nil
+	return &effective
+}
+
+//portPending returns the pending preference of a ported MSISDN with the service provider, LRN and owner
+//of the ported record, so the port is kept when the pending preference comes into effect
+func portPending(pending *Preference, ported *Preference) *Preference {
+	if pending == nil {
+		return nil
+	}
+	recipient := *pending
+	recipient.ServiceProvider = ported.ServiceProvider
+	recipient.Lrn = ported.Lrn
+	recipient.UpdateTs = ported.UpdateTs
+	recipient.UpdatedBy = ported.UpdatedBy
+	recipient.PortID = ported.PortID
+	return &recipient
+}
+
+//isChangeTooSoon checks whether the previous change of the MSISDN is within the minimum interval
+func isChangeTooSoon(existing *Preference, config *Config, txTime int64) bool {
+	if existing == nil || existing.LastChangeTs == "" {
+		return false
+	}
+	lastChange, err := parseTime(existing.LastChangeTs)
+	if err != nil {
+		return false
+	}
+	return txTime < lastChange+config.MinChangeInterval
+}
+
+//takesEffectAt returns the effective time of the latest change held in the stored record
+func takesEffectAt(preference *Preference) string {
+	if preference.Pending != nil {
+		return preference.Pending.EffectiveFrom
+	}
+	return preference.EffectiveFrom
+}
+
+//schedulePreference returns the record to store for the incoming preference. A new MSISDN, or one
+//whose preference is not in effect yet, takes the incoming preference as current, otherwise the
+//incoming preference is kept pending next to the current one until the processing window is over
+func schedulePreference(existing *Preference, incoming *Preference, config *Config, txTime int64) *Preference {
+	incoming.Pending = nil
+	incoming.EffectiveFrom = formatTime(txTime + config.ProcessingWindow)
+	incoming.LastChangeTs = formatTime(txTime)
+	if existing == nil {
+		return incoming
+	}
+	current := promotePreference(existing, txTime)
+	if !isEffective(current, txTime) {
+		return incoming
+	}
+	record := *current
+	record.Pending = incoming
+	record.LastChangeTs = incoming.LastChangeTs
+	record.UpdatedBy = incoming.UpdatedBy
+	return &record
+}
+
+//=====================================================================================
+//getPreference returns the preference of the MSISDN in effect at the requested time, a
+//registration not in effect yet is reported with the time it takes effect.
+//Arguments [msisdn] or [msisdn, time]
+//=====================================================================================
+
+func (dlp *CPM) getPreference(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 && len(args) != 2 {
+		logger.Errorf("getPreference : Incorrect number of arguments, Expected 1 [msisdn] or 2 [msisdn,time]")
+		return shim.Error("getPreference : Incorrect number of arguments, Expected 1 [msisdn] or 2 [msisdn,time]")
+	}
+	var at int64
+	var err error
+	if len(args) == 2 {
+		at, err = parseTime(args[1])
+		if err != nil {
+			return shim.Error("{\"Error\":\"time is not numeric \"}")
+		}
+	} else {
+		at, err = getTxTime(stub)
+		if err != nil {
+			logger.Errorf("getPreference : Getting Transaction Timestamp Error : " + string(err.Error()))
+			return shim.Error("getPreference : Getting Transaction Timestamp Error : " + string(err.Error()))
+		}
+	}
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		logger.Errorf("getPreference : Getting Transaction Timestamp Error : " + string(err.Error()))
+		return shim.Error("getPreference : Getting Transaction Timestamp Error : " + string(err.Error()))
+	}
+	var preference, stored *Preference
+	if at >= txTime {
+		value, err := stub.GetState(args[0])
+		if err != nil {
+			logger.Errorf("getPreference : GetState Failed for MSISDN : " + args[0] + " , Error : " + string(err.Error()))
+			return shim.Error("getPreference : GetState Failed for MSISDN : " + args[0] + " , Error : " + string(err.Error()))
+		}
+		if value != nil {
+			preference = &Preference{}
+			if err := json.Unmarshal(value, preference); err != nil {
+				logger.Errorf("getPreference : Existing prefernce data Unmarhsaling Error : " + string(err.Error()))
+				return shim.Error("getPreference : Existing prefernce data Unmarhsaling Error : " + string(err.Error()))
+			}
+			stored = preference
+			preference = effectivePreference(preference, at)
+		}
+	} else {
+		preference, err = getPreferenceAt(stub, args[0], at)
+		if err != nil {
+			logger.Errorf("getPreference : Preference History Failed for MSISDN : " + args[0] + " , Error : " + string(err.Error()))
+			return shim.Error("getPreference : Preference History Failed for MSISDN : " + args[0] + " , Error : " + string(err.Error()))
+		}
+	}
+	if preference == nil && stored != nil && stored.Status != PREFCHURNED {
+		return shim.Error("getPreference : No Effective preferences for MSISDN : " + args[0] + " at " + formatTime(at) + " , registered preferences take effect at " + takesEffectAt(stored))
+	}
+	if preference == nil {
+		return shim.Error("getPreference : No Effective preferences for MSISDN : " + args[0] + " at " + formatTime(at))
+	}
+	PrfAsBytes, err := json.Marshal(preference)
+	if err != nil {
+		logger.Errorf("getPreference : Marshalling Error : " + string(err.Error()))
+		return shim.Error("getPreference : Marshalling Error : " + string(err.Error()))
+	}
+	return shim.Success(PrfAsBytes)
+}
@@ -0,0 +1,246 @@
+/*
+Copyright Tanla Solutions Ltd. 2019 All Rights Reserved.
+Encoder shared by the query functions. Records are written as a
+JSON array, a JSON envelope, NDJSON or CSV until the configured byte
+limit, a truncated response carries the bookmark that continues it
+and an array over the limit is refused.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json" //reading and writing JSON
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim" // import for Chaincode Interface
+)
+
+//Output Formats
+const FORMATARRAY = "array"
+const FORMATJSON = "json"
+const FORMATNDJSON = "ndjson"
+const FORMATCSV = "csv"
+
+//BOOKMARKSKIP prefixes the continuation bookmark of a truncated response, skip:<records>:<bookmark>
+const BOOKMARKSKIP = "skip:"
+
+//Columns of the CSV format after the key by record type, value holds the values that are not JSON objects
+var preferenceColumns = []string{"obj", "msisdn", "svcprv", "reqno", "rmode", "ctgr", "cmode", "day", "time", "lrn", "uts", "cts", "uby", "eff", "lcts", "pending", "portid", "status", "churn", "value"}
+var portColumns = []string{"obj", "msisdn", "seq", "donor", "recipient", "lrnb", "lrna", "portid", "pts", "eff", "pby", "value"}
+var archiveColumns = []string{"obj", "msisdn", "gen", "rby", "rts", "pref", "value"}
+var slaColumns = []string{"complaint", "breached", "value"}
+var statColumns = []string{"operator", "dimension", "value", "total", "rolled", "dates"}
+
+//QueryRecord Structure for a record of a query response
+type QueryRecord struct {
+	Key    string      `json:"Key"`
+	Record interface{} `json:"Record"`
+}
+
+//QueryMetadata Structure for the response metadata of a query. FetchedCount is the number of records read
+//from the state database, including the records left out of the response. Truncated is set when the
+//byte limit stopped the response, Bookmark then continues it
+type QueryMetadata struct {
+	FetchedCount int32  `json:"FetchedCount"`
+	Bookmark     string `json:"Bookmark"`
+	Truncated    bool   `json:"Truncated"`
+}
+
+//resultEncoder writes the records of a query in an output format. The records read before the skip of a
+//continuation bookmark are passed over, the writing stops at the byte limit
+type resultEncoder struct {
+	format    string
+	columns   []string
+	limit     int
+	bookmark  string
+	skip      int
+	position  int
+	written   int
+	truncated bool
+	buffer    bytes.Buffer
+}
+
+//newResultEncoder returns the encoder of the format and the bookmark of the state database to query,
+//a continuation bookmark is resolved to the bookmark it continues. columns are the CSV columns of the records.
+//The format defaults to the envelope of the paged queries, the other queries default to the array
+func newResultEncoder(format string, columns []string, limit int, bookmark string) (*resultEncoder, string, error) {
+	if format == "" {
+		format = FORMATJSON
+	}
+	if format != FORMATARRAY && format != FORMATJSON && format != FORMATNDJSON && format != FORMATCSV {
+		return nil, "", errors.New("format shall be array, json, ndjson or csv")
+	}
+	encoder := &resultEncoder{format: format, columns: columns, limit: limit, bookmark: bookmark}
+	if strings.HasPrefix(bookmark, BOOKMARKSKIP) {
+		parts := strings.SplitN(strings.TrimPrefix(bookmark, BOOKMARKSKIP), ":", 2)
+		skip, err := strconv.Atoi(parts[0])
+		if err != nil || skip < 0 || len(parts) != 2 {
+			return nil, "", errors.New("bookmark is not a valid continuation")
+		}
+		encoder.skip = skip
+		encoder.bookmark = parts[1]
+	}
+	switch format {
+	case FORMATARRAY:
+		encoder.buffer.WriteString("[")
+	case FORMATJSON:
+		encoder.buffer.WriteString("{\"Records\":[")
+	case FORMATCSV:
+		encoder.buffer.Write(csvRow(append([]string{"key"}, columns...)))
+	}
+	return encoder, encoder.bookmark, nil
+}
+
+//next counts a record read from the state database and returns false for the records of the skip
+func (encoder *resultEncoder) next() bool {
+	encoder.position++
+	return encoder.position > encoder.skip
+}
+
+//rawRecord returns the stored value as a record, values that are not valid JSON are wrapped in a JSON string
+func rawRecord(value []byte) interface{} {
+	if json.Valid(value) {
+		return json.RawMessage(value)
+	}
+	return string(value)
+}
+
+//csvRow returns the CSV line of the cells
+func csvRow(cells []string) []byte {
+	var line bytes.Buffer
+	writer := csv.NewWriter(&line)
+	writer.Write(cells)
+	writer.Flush()
+	return line.Bytes()
+}
+
+//csvCells returns the key and the columns of the record, the properties that are not strings are written as JSON
+func csvCells(key string, RecordAsBytes []byte, columns []string) []string {
+	cells := []string{key}
+	properties := map[string]interface{}{}
+	if json.Unmarshal(RecordAsBytes, &properties) != nil {
+		properties = map[string]interface{}{"value": string(RecordAsBytes)}
+		text := ""
+		if json.Unmarshal(RecordAsBytes, &text) == nil {
+			properties["value"] = text
+		}
+	}
+	for _, column := range columns {
+		switch property := properties[column].(type) {
+		case nil:
+			cells = append(cells, "")
+		case string:
+			cells = append(cells, property)
+		default:
+			PropertyAsBytes, _ := json.Marshal(property)
+			cells = append(cells, string(PropertyAsBytes))
+		}
+	}
+	return cells
+}
+
+//encode writes the record, false is returned when the byte limit is reached and the response is truncated.
+//The first record is always written, so that a continuation makes progress. An array has no bookmark to
+//continue it and is refused at the byte limit
+func (encoder *resultEncoder) encode(key string, record interface{}) (bool, error) {
+	entry, err := json.Marshal(QueryRecord{Key: key, Record: record})
+	if err != nil {
+		return false, err
+	}
+	switch encoder.format {
+	case FORMATARRAY, FORMATJSON:
+		if encoder.written > 0 {
+			entry = append([]byte(","), entry...)
+		}
+	case FORMATNDJSON:
+		entry = append(entry, '\n')
+	case FORMATCSV:
+		RecordAsBytes, err := json.Marshal(record)
+		if err != nil {
+			return false, err
+		}
+		entry = csvRow(csvCells(key, RecordAsBytes, encoder.columns))
+	}
+	if encoder.written > 0 && encoder.buffer.Len()+len(entry) > encoder.limit {
+		if encoder.format == FORMATARRAY {
+			return false, errors.New("response exceeds the maxqb of " + strconv.Itoa(encoder.limit) + " bytes, query with the json format to continue it by its bookmark")
+		}
+		encoder.truncated = true
+		return false, nil
+	}
+	encoder.buffer.Write(entry)
+	encoder.written++
+	return true, nil
+}
+
+//finish writes the response metadata and returns the response. nextBookmark is the bookmark of the state
+//database for the next page, a truncated response returns the continuation bookmark of the record not written.
+//An array is returned without the metadata
+func (encoder *resultEncoder) finish(nextBookmark string) ([]byte, error) {
+	metadata := QueryMetadata{FetchedCount: int32(encoder.position - encoder.skip), Bookmark: nextBookmark}
+	if encoder.truncated {
+		metadata.FetchedCount--
+		metadata.Truncated = true
+		metadata.Bookmark = BOOKMARKSKIP + strconv.Itoa(encoder.position-1) + ":" + encoder.bookmark
+	}
+	MetadataAsBytes, err := json.Marshal(metadata)
+	if err != nil {
+		return nil, err
+	}
+	switch encoder.format {
+	case FORMATARRAY:
+		encoder.buffer.WriteString("]")
+	case FORMATJSON:
+		encoder.buffer.WriteString("],\"ResponseMetadata\":")
+		encoder.buffer.Write(MetadataAsBytes)
+		encoder.buffer.WriteString("}")
+	case FORMATNDJSON:
+		encoder.buffer.WriteString("{\"ResponseMetadata\":")
+		encoder.buffer.Write(MetadataAsBytes)
+		encoder.buffer.WriteString("}\n")
+	case FORMATCSV:
+		encoder.buffer.Write(csvRow([]string{"#ResponseMetadata", string(MetadataAsBytes)}))
+	}
+	return encoder.buffer.Bytes(), nil
+}
+
+//encodeResults writes the records of the iterator until the response is truncated. recordOf returns the key
+//and the record of a result as seen by the caller, a nil record is left out of the response
+func encodeResults(resultsIterator shim.StateQueryIteratorInterface, encoder *resultEncoder, recordOf func(key string, value []byte) (string, interface{}, error)) error {
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return err
+		}
+		if !encoder.next() {
+			continue
+		}
+		key, record, err := recordOf(queryResponse.Key, queryResponse.Value)
+		if err != nil {
+			return err
+		}
+		if record == nil {
+			continue
+		}
+		written, err := encoder.encode(key, record)
+		if err != nil {
+			return err
+		}
+		if !written {
+			return nil
+		}
+	}
+	return nil
+}
+
+//storedRecord returns the stored value as the record, tombstones of churned MSISDNs are retrievable only by the audit query
+func storedRecord(key string, value []byte) (string, interface{}, error) {
+	if isChurnedRecord(value) {
+		return key, nil, nil
+	}
+	return key, rawRecord(value), nil
+}
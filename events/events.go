@@ -0,0 +1,87 @@
+/*
+Copyright Tanla Solutions Ltd. 2019 All Rights Reserved.
+Payload structures of the aggregated batch events published by
+the Preferences chaincode and the decoder used by event listeners.
+*/
+
+package events
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json" //reading and writing JSON
+	"errors"
+)
+
+//Envelope Structure, every chaincode event payload is wrapped in it
+type Envelope struct {
+	Data string `json:"data"`
+	Txid string `json:"txid"`
+}
+
+//BatchItem Structure for an MSISDN affected by a batch transaction, Operation is
+//created, updated, deleted or ported, Record the new ledger record if any and
+//Reason the churn reason of a deletion
+type BatchItem struct {
+	Phone     string          `json:"msisdn"`
+	Operation string          `json:"op"`
+	Record    json.RawMessage `json:"record,omitempty"`
+	Reason    string          `json:"reason,omitempty"`
+}
+
+//BatchEvent Structure for the single event of a batch transaction. When the items
+//exceed the event size limit only Count, Digest and PointerKey are published, and the
+//complete event is stored on the ledger under PointerKey
+type BatchEvent struct {
+	Txid       string      `json:"txid"`
+	Count      int         `json:"count"`
+	Items      []BatchItem `json:"items,omitempty"`
+	Digest     string      `json:"digest,omitempty"`
+	PointerKey string      `json:"ptr,omitempty"`
+}
+
+//Digest returns the hex encoded sha256 of the stored complete event
+func Digest(stored []byte) string {
+	sum := sha256.Sum256(stored)
+	return hex.EncodeToString(sum[:])
+}
+
+//IsComplete reports whether the event carries its items or only points to them
+func (event *BatchEvent) IsComplete() bool {
+	return event.PointerKey == ""
+}
+
+//Decode decodes the payload of a batch event as received by a listener
+func Decode(payload []byte) (*BatchEvent, error) {
+	envelope := Envelope{}
+	if err := json.Unmarshal(payload, &envelope); err != nil {
+		return nil, err
+	}
+	event := &BatchEvent{}
+	if err := json.Unmarshal([]byte(envelope.Data), event); err != nil {
+		return nil, err
+	}
+	if event.Txid != envelope.Txid {
+		return nil, errors.New("batch event txid " + event.Txid + " does not match the envelope txid " + envelope.Txid)
+	}
+	return event, nil
+}
+
+//Resolve decodes the complete event read from the ledger under the pointer key of a compact
+//event and checks it against the digest and transaction of the compact event
+func Resolve(compact *BatchEvent, stored []byte) (*BatchEvent, error) {
+	if compact.IsComplete() {
+		return compact, nil
+	}
+	if Digest(stored) != compact.Digest {
+		return nil, errors.New("stored batch event does not match the digest of transaction " + compact.Txid)
+	}
+	event := &BatchEvent{}
+	if err := json.Unmarshal(stored, event); err != nil {
+		return nil, err
+	}
+	if event.Txid != compact.Txid || event.Count != compact.Count {
+		return nil, errors.New("stored batch event does not belong to transaction " + compact.Txid)
+	}
+	return event, nil
+}
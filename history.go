@@ -0,0 +1,301 @@
+/*
+Copyright Tanla Solutions Ltd. 2019 All Rights Reserved.
+Port history of the MSISDNs. Every port is kept under its MSISDN
+and sequence number, with the entries of the donor and recipient
+service providers by date, so the ownership timeline of a number
+and the ports in and out of a service provider are read without
+rich queries.
+*/
+
+package main
+
+import (
+	"encoding/json" //reading and writing JSON
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim" // import for Chaincode Interface
+	pb "github.com/hyperledger/fabric/protos/peer"      // import for peer response
+)
+
+//Composite Key Object Types
+const KEYPORTHISTORY = "PORTHIST"
+const KEYPORTSEQUENCE = "PORTSEQ"
+const KEYPORTOPERATOR = "PORTOPR"
+
+//Port Directions of an operator
+const PORTIN = "in"
+const PORTOUT = "out"
+
+//MAXPORTDAYS is the longest date range of a port query
+const MAXPORTDAYS = 366
+
+//PortRecord Structure for a port of an MSISDN. Donor and Recipient are the service providers before and
+//after the port, LrnBefore and LrnAfter the LRNs. PortTs is the transaction time the port is recorded at,
+//EffectiveTs the time given by the porting operator and PortedBy the organization that ported the MSISDN
+type PortRecord struct {
+	ObjType     string `json:"obj"`
+	Phone       string `json:"msisdn"`
+	Sequence    int    `json:"seq"`
+	Donor       string `json:"donor"`
+	Recipient   string `json:"recipient"`
+	LrnBefore   string `json:"lrnb"`
+	LrnAfter    string `json:"lrna"`
+	PortID      string `json:"portid"`
+	PortTs      string `json:"pts"`
+	EffectiveTs string `json:"eff"`
+	PortedBy    string `json:"pby"`
+}
+
+//sequenceKey formats the sequence number so the history keys sort in port order
+func sequenceKey(sequence int) string {
+	return fmt.Sprintf("%06d", sequence)
+}
+
+//getPortSequence reads the number of ports recorded for the MSISDN
+func getPortSequence(stub shim.ChaincodeStubInterface, msisdn string) (int, error) {
+	key, err := stub.CreateCompositeKey(KEYPORTSEQUENCE, []string{msisdn})
+	if err != nil {
+		return 0, err
+	}
+	value, err := stub.GetState(key)
+	if err != nil || value == nil {
+		return 0, err
+	}
+	return strconv.Atoi(string(value))
+}
+
+//recordPort stores the port from the previous to the current record of an MSISDN in the port history,
+//with the entries of the donor and the recipient service provider under the date of the transaction
+func recordPort(stub shim.ChaincodeStubInterface, previous *Preference, current *Preference, organization string, txTime int64) error {
+	sequence, err := getPortSequence(stub, current.Phone)
+	if err != nil {
+		return err
+	}
+	sequence++
+	port := PortRecord{ObjType: "PortHistory", Phone: current.Phone, Sequence: sequence, Donor: previous.ServiceProvider, Recipient: current.ServiceProvider, LrnBefore: previous.Lrn, LrnAfter: current.Lrn, PortID: current.PortID, PortTs: formatTime(txTime), EffectiveTs: current.UpdateTs, PortedBy: organization}
+	PortAsBytes, err := json.Marshal(port)
+	if err != nil {
+		return err
+	}
+	historyKey, err := stub.CreateCompositeKey(KEYPORTHISTORY, []string{current.Phone, sequenceKey(sequence)})
+	if err != nil {
+		return err
+	}
+	if err := stub.PutState(historyKey, PortAsBytes); err != nil {
+		return err
+	}
+	counterKey, err := stub.CreateCompositeKey(KEYPORTSEQUENCE, []string{current.Phone})
+	if err != nil {
+		return err
+	}
+	if err := stub.PutState(counterKey, []byte(strconv.Itoa(sequence))); err != nil {
+		return err
+	}
+	date := time.Unix(txTime, 0).UTC().Format("2006-01-02")
+	for direction, serviceProvider := range map[string]string{PORTOUT: port.Donor, PORTIN: port.Recipient} {
+		key, err := stub.CreateCompositeKey(KEYPORTOPERATOR, []string{serviceProvider, direction, date, current.Phone, sequenceKey(sequence)})
+		if err != nil {
+			return err
+		}
+		if err := stub.PutState(key, indexEntryValue); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//tookPart checks whether the organization ported the MSISDN or owns the service provider code of the donor
+//or the recipient, serviceProviders caches the organizations bound to the service provider codes
+func tookPart(stub shim.ChaincodeStubInterface, port *PortRecord, organization string, serviceProviders map[string]string) (bool, error) {
+	if strings.Compare(port.PortedBy, organization) == 0 {
+		return true, nil
+	}
+	for _, serviceProvider := range []string{port.Donor, port.Recipient} {
+		bound, ok := serviceProviders[serviceProvider]
+		if !ok {
+			var err error
+			bound, err = getServiceProviderOperator(stub, serviceProvider)
+			if err != nil {
+				return false, err
+			}
+			serviceProviders[serviceProvider] = bound
+		}
+		if strings.Compare(bound, organization) == 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+//=====================================================================================
+//queryPortHistory for the ownership timeline of an MSISDN, the ports in sequence order.
+//Arguments [msisdn], [msisdn, bookmark] or [msisdn, bookmark, format], the format
+//defaults to a JSON array refused over the configured maxqb, the bookmark continues
+//a json, ndjson or csv response truncated at maxqb. The regulator sees every port,
+//an operator the ports it took part in as the porting organization or as the owner
+//of the donor or recipient service provider code
+//=====================================================================================
+
+func (dlp *CPM) queryPortHistory(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 1 || len(args) > 3 {
+		return shim.Error("queryPortHistory : Incorrect number of arguments, Expected 1 [msisdn], 2 [msisdn, bookmark] or 3 [msisdn, bookmark, format]")
+	}
+	bookmark, format := "", ""
+	if len(args) > 1 {
+		bookmark = args[1]
+	}
+	if len(args) > 2 {
+		format = args[2]
+	}
+	if format == "" {
+		format = FORMATARRAY
+	}
+	config, err := getConfig(stub)
+	if err != nil {
+		logger.Errorf("queryPortHistory : GetState Failed for Config Error : " + string(err.Error()))
+		return shim.Error("queryPortHistory : GetState Failed for Config Error : " + string(err.Error()))
+	}
+	organization, err := getOrganization(stub)
+	if err != nil {
+		logger.Errorf("queryPortHistory : Getting certificate Details Error : " + string(err.Error()))
+		return shim.Error("queryPortHistory : Getting certificate Details Error : " + string(err.Error()))
+	}
+	regulator := isRegulator(config, organization)
+	encoder, _, err := newResultEncoder(format, portColumns, config.MaxQueryBytes, bookmark)
+	if err != nil {
+		return shim.Error("{\"Error\":\"" + err.Error() + " \"}")
+	}
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(KEYPORTHISTORY, []string{args[0]})
+	if err != nil {
+		logger.Errorf("queryPortHistory : GetStateByPartialCompositeKey Failed Error : " + string(err.Error()))
+		return shim.Error("queryPortHistory : GetStateByPartialCompositeKey Failed Error : " + string(err.Error()))
+	}
+	defer resultsIterator.Close()
+	serviceProviders := make(map[string]string)
+	err = encodeResults(resultsIterator, encoder, func(_ string, value []byte) (string, interface{}, error) {
+		if regulator {
+			return args[0], rawRecord(value), nil
+		}
+		port := &PortRecord{}
+		if err := json.Unmarshal(value, port); err != nil {
+			return args[0], nil, err
+		}
+		visible, err := tookPart(stub, port, organization, serviceProviders)
+		if err != nil || !visible {
+			return args[0], nil, err
+		}
+		return args[0], rawRecord(value), nil
+	})
+	if err != nil {
+		logger.Errorf("queryPortHistory : Iterator Error : " + string(err.Error()))
+		return shim.Error("queryPortHistory : Iterator Error : " + string(err.Error()))
+	}
+	PortsAsBytes, err := encoder.finish("")
+	if err != nil {
+		logger.Errorf("queryPortHistory : Marshalling Error : " + string(err.Error()))
+		return shim.Error("queryPortHistory : Marshalling Error : " + string(err.Error()))
+	}
+	return shim.Success(PortsAsBytes)
+}
+
+//=====================================================================================
+//queryOperatorPorts for the MSISDNs ported in or out of a service provider in a date range.
+//Arguments [svcprv, direction, from, to], [.., bookmark] or [.., bookmark, format], the
+//direction is in or out and the dates YYYY-MM-DD, both included, at most MAXPORTDAYS
+//apart. An operator queries the service provider codes bound to it, the regulator any. The format defaults to a JSON array refused over the configured maxqb,
+//the bookmark continues a json, ndjson or csv response truncated at maxqb
+//=====================================================================================
+
+func (dlp *CPM) queryOperatorPorts(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 4 || len(args) > 6 {
+		return shim.Error("queryOperatorPorts : Incorrect number of arguments, Expected 4 [svcprv, direction, from, to], 5 [svcprv, direction, from, to, bookmark] or 6 [svcprv, direction, from, to, bookmark, format]")
+	}
+	serviceProvider, direction := args[0], args[1]
+	if direction != PORTIN && direction != PORTOUT {
+		return shim.Error("{\"Error\":\"direction shall be in or out \"}")
+	}
+	from, err := time.Parse("2006-01-02", args[2])
+	if err != nil {
+		return shim.Error("{\"Error\":\"from shall be a YYYY-MM-DD date \"}")
+	}
+	to, err := time.Parse("2006-01-02", args[3])
+	if err != nil {
+		return shim.Error("{\"Error\":\"to shall be a YYYY-MM-DD date \"}")
+	}
+	if to.Before(from) || to.Sub(from) >= MAXPORTDAYS*24*time.Hour {
+		return shim.Error("{\"Error\":\"to shall be after from and at most " + strconv.Itoa(MAXPORTDAYS) + " days apart \"}")
+	}
+	bookmark, format := "", ""
+	if len(args) > 4 {
+		bookmark = args[4]
+	}
+	if len(args) > 5 {
+		format = args[5]
+	}
+	if format == "" {
+		format = FORMATARRAY
+	}
+	config, err := getConfig(stub)
+	if err != nil {
+		logger.Errorf("queryOperatorPorts : GetState Failed for Config Error : " + string(err.Error()))
+		return shim.Error("queryOperatorPorts : GetState Failed for Config Error : " + string(err.Error()))
+	}
+	organization, err := getOrganization(stub)
+	if err != nil {
+		logger.Errorf("queryOperatorPorts : Getting certificate Details Error : " + string(err.Error()))
+		return shim.Error("queryOperatorPorts : Getting certificate Details Error : " + string(err.Error()))
+	}
+	if !isRegulator(config, organization) {
+		bound, err := getServiceProviderOperator(stub, serviceProvider)
+		if err != nil {
+			logger.Errorf("queryOperatorPorts : GetState Failed for Service Provider : " + serviceProvider + " , Error : " + string(err.Error()))
+			return shim.Error("queryOperatorPorts : GetState Failed for Service Provider : " + serviceProvider + " , Error : " + string(err.Error()))
+		}
+		if strings.Compare(bound, organization) != 0 {
+			logger.Errorf("Unauthorized Access")
+			return shim.Error("Unauthorized Access")
+		}
+	}
+	encoder, _, err := newResultEncoder(format, portColumns, config.MaxQueryBytes, bookmark)
+	if err != nil {
+		return shim.Error("{\"Error\":\"" + err.Error() + " \"}")
+	}
+	recordOf := func(key string, _ []byte) (string, interface{}, error) {
+		_, attributes, err := stub.SplitCompositeKey(key)
+		if err != nil || len(attributes) != 5 {
+			return key, nil, nil
+		}
+		historyKey, err := stub.CreateCompositeKey(KEYPORTHISTORY, attributes[3:])
+		if err != nil {
+			return key, nil, err
+		}
+		value, err := stub.GetState(historyKey)
+		if err != nil || value == nil {
+			return attributes[3], nil, err
+		}
+		return attributes[3], rawRecord(value), nil
+	}
+	//The days are read one by one in date order, the positions of a continuation run over all of them
+	for day := from; !day.After(to) && !encoder.truncated; day = day.AddDate(0, 0, 1) {
+		resultsIterator, err := stub.GetStateByPartialCompositeKey(KEYPORTOPERATOR, []string{serviceProvider, direction, day.Format("2006-01-02")})
+		if err != nil {
+			logger.Errorf("queryOperatorPorts : GetStateByPartialCompositeKey Failed Error : " + string(err.Error()))
+			return shim.Error("queryOperatorPorts : GetStateByPartialCompositeKey Failed Error : " + string(err.Error()))
+		}
+		err = encodeResults(resultsIterator, encoder, recordOf)
+		resultsIterator.Close()
+		if err != nil {
+			logger.Errorf("queryOperatorPorts : Iterator Error : " + string(err.Error()))
+			return shim.Error("queryOperatorPorts : Iterator Error : " + string(err.Error()))
+		}
+	}
+	PortsAsBytes, err := encoder.finish("")
+	if err != nil {
+		logger.Errorf("queryOperatorPorts : Marshalling Error : " + string(err.Error()))
+		return shim.Error("queryOperatorPorts : Marshalling Error : " + string(err.Error()))
+	}
+	return shim.Success(PortsAsBytes)
+}
@@ -0,0 +1,310 @@
+/*
+Copyright Tanla Solutions Ltd. 2019 All Rights Reserved.
+Composite key secondary indexes of the preferences by operator,
+LRN, category and update date, usable on LevelDB peers where rich
+queries are not available. The entries are maintained on every
+write of a preference.
+*/
+
+package main
+
+import (
+	"encoding/json" //reading and writing JSON
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim" // import for Chaincode Interface
+	pb "github.com/hyperledger/fabric/protos/peer"      // import for peer response
+)
+
+//Composite Key Object Types of the indexes, the attributes are the indexed value and the MSISDN
+const IDXOPERATOR = "IDXOPR"
+const IDXLRN = "IDXLRN"
+const IDXCATEGORY = "IDXCTGR"
+const IDXUPDATED = "IDXUTS"
+
+//indexNames are the index object types by the name used in the query arguments
+var indexNames = map[string]string{
+	"operator": IDXOPERATOR,
+	"lrn":      IDXLRN,
+	"category": IDXCATEGORY,
+	"updated":  IDXUPDATED,
+}
+
+//IndexRebuild Structure for the response of an index rebuild call, NextKey is the startKey of the next call
+type IndexRebuild struct {
+	Indexed int    `json:"indexed"`
+	Scanned int    `json:"scanned"`
+	NextKey string `json:"next"`
+}
+
+//indexEntryValue is stored under every index entry, the entry key holds the data
+var indexEntryValue = []byte{0x00}
+
+//updateDate returns the UTC date of the epoch seconds update time as YYYY-MM-DD, empty when it is not numeric
+func updateDate(updateTs string) string {
+	seconds, err := parseTime(updateTs)
+	if err != nil {
+		return ""
+	}
+	return time.Unix(seconds, 0).UTC().Format("2006-01-02")
+}
+
+//indexEntries returns the index object types and values of the preference, without its pending preference
+func indexEntries(indexed *Preference) [][2]string {
+	entries := [][2]string{{IDXOPERATOR, indexed.UpdatedBy}, {IDXLRN, indexed.Lrn}, {IDXUPDATED, updateDate(indexed.UpdateTs)}}
+	for _, code := range strings.Split(indexed.Category, ",") {
+		entries = append(entries, [2]string{IDXCATEGORY, strings.TrimSpace(code)})
+	}
+	return entries
+}
+
+//isIndexed checks whether the preference in effect at the given time holds the index value. The entries
+//of a record also hold the values of its pending preference, which are stale before it takes effect
+//and the values it replaces are stale after
+func isIndexed(preference *Preference, index string, value string, at int64) bool {
+	effective := effectivePreference(preference, at)
+	if effective == nil {
+		return false
+	}
+	for _, indexEntry := range indexEntries(effective) {
+		if indexEntry[0] == index && indexEntry[1] == value {
+			return true
+		}
+	}
+	return false
+}
+
+//indexKeys returns the index entry keys of the stored preference and of its pending preference,
+//so the entries hold before and after the pending preference takes effect. A tombstone has no entries
+func indexKeys(stub shim.ChaincodeStubInterface, preference *Preference) ([]string, error) {
+	if preference == nil || preference.Status == PREFCHURNED {
+		return nil, nil
+	}
+	var entries [][2]string
+	for _, indexed := range []*Preference{preference, preference.Pending} {
+		if indexed != nil {
+			entries = append(entries, indexEntries(indexed)...)
+		}
+	}
+	var keys []string
+	added := make(map[string]bool)
+	for _, indexEntry := range entries {
+		if indexEntry[1] == "" {
+			continue
+		}
+		key, err := stub.CreateCompositeKey(indexEntry[0], []string{indexEntry[1], preference.Phone})
+		if err != nil {
+			return nil, err
+		}
+		if !added[key] {
+			added[key] = true
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+//updatePreferenceIndexes replaces the index entries of the previous record of an MSISDN by those
+//of the current record, nil is passed for a record that does not exist
+func updatePreferenceIndexes(stub shim.ChaincodeStubInterface, previous *Preference, current *Preference) error {
+	previousKeys, err := indexKeys(stub, previous)
+	if err != nil {
+		return err
+	}
+	currentKeys, err := indexKeys(stub, current)
+	if err != nil {
+		return err
+	}
+	kept := make(map[string]bool)
+	for _, key := range currentKeys {
+		kept[key] = true
+	}
+	for _, key := range previousKeys {
+		if kept[key] {
+			continue
+		}
+		if err := stub.DelState(key); err != nil {
+			return err
+		}
+	}
+	for _, key := range currentKeys {
+		if err := stub.PutState(key, indexEntryValue); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//=====================================================================================
+//queryPreferencesByIndex for the preferences of an index value page by page, without rich queries.
+//Arguments [index, value, pageSize], [index, value, pageSize, bookmark] or [index, value, pageSize,
+//bookmark, format], the index is operator, lrn, category or updated (YYYY-MM-DD). The hits are
+//checked against the preference in effect at the transaction time, the stale ones are left out,
+//and the rows are filtered as in guardedQuery
+//=====================================================================================
+
+func (dlp *CPM) queryPreferencesByIndex(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 3 || len(args) > 5 {
+		return shim.Error("queryPreferencesByIndex : Incorrect number of arguments, Expected 3 [index, value, pageSize], 4 [index, value, pageSize, bookmark] or 5 [index, value, pageSize, bookmark, format]")
+	}
+	index, ok := indexNames[args[0]]
+	if !ok {
+		return shim.Error("{\"Error\":\"index shall be operator, lrn, category or updated \"}")
+	}
+	pageSize, err := strconv.ParseInt(args[2], 10, 32)
+	if err != nil || pageSize <= 0 {
+		return shim.Error("{\"Error\":\"Page Size is not a positive number \"}")
+	}
+	bookmark, format := "", ""
+	if len(args) > 3 {
+		bookmark = args[3]
+	}
+	if len(args) > 4 {
+		format = args[4]
+	}
+	organization, err := getOrganization(stub)
+	if err != nil {
+		logger.Errorf("queryPreferencesByIndex : Getting certificate Details Error : " + string(err.Error()))
+		return shim.Error("queryPreferencesByIndex : Getting certificate Details Error : " + string(err.Error()))
+	}
+	config, err := getConfig(stub)
+	if err != nil {
+		logger.Errorf("queryPreferencesByIndex : GetState Failed for Config Error : " + string(err.Error()))
+		return shim.Error("queryPreferencesByIndex : GetState Failed for Config Error : " + string(err.Error()))
+	}
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		logger.Errorf("queryPreferencesByIndex : Getting Transaction Timestamp Error : " + string(err.Error()))
+		return shim.Error("queryPreferencesByIndex : Getting Transaction Timestamp Error : " + string(err.Error()))
+	}
+	regulator := isRegulator(config, organization)
+	if index == IDXOPERATOR && !regulator && strings.Compare(args[1], organization) != 0 {
+		return shim.Error("{\"Error\":\"value shall be the own operator \"}")
+	}
+	if int32(pageSize) > config.MaxQueryResults {
+		pageSize = int64(config.MaxQueryResults)
+	}
+	encoder, bookmark, err := newResultEncoder(format, preferenceColumns, config.MaxQueryBytes, bookmark)
+	if err != nil {
+		return shim.Error("{\"Error\":\"" + err.Error() + " \"}")
+	}
+	resultsIterator, responseMetadata, err := stub.GetStateByPartialCompositeKeyWithPagination(index, []string{args[1]}, int32(pageSize), bookmark)
+	if err != nil {
+		logger.Errorf("queryPreferencesByIndex : GetStateByPartialCompositeKeyWithPagination Failed Error : " + string(err.Error()))
+		return shim.Error("queryPreferencesByIndex : GetStateByPartialCompositeKeyWithPagination Failed Error : " + string(err.Error()))
+	}
+	defer resultsIterator.Close()
+	err = encodeResults(resultsIterator, encoder, func(key string, _ []byte) (string, interface{}, error) {
+		_, attributes, err := stub.SplitCompositeKey(key)
+		if err != nil || len(attributes) != 2 {
+			return key, nil, nil
+		}
+		value, err := stub.GetState(attributes[1])
+		if err != nil {
+			return key, nil, errors.New("GetState Failed for MSISDN : " + attributes[1] + " , Error : " + string(err.Error()))
+		}
+		preference := &Preference{}
+		if value == nil || json.Unmarshal(value, preference) != nil || !isIndexed(preference, index, args[1], txTime) {
+			return attributes[1], nil, nil
+		}
+		return attributes[1], guardRecord(value, organization, regulator, txTime), nil
+	})
+	if err != nil {
+		logger.Errorf("queryPreferencesByIndex : Iterator Error : " + string(err.Error()))
+		return shim.Error("queryPreferencesByIndex : Iterator Error : " + string(err.Error()))
+	}
+	PageAsBytes, err := encoder.finish(responseMetadata.Bookmark)
+	if err != nil {
+		logger.Errorf("queryPreferencesByIndex : Marshalling Error : " + string(err.Error()))
+		return shim.Error("queryPreferencesByIndex : Marshalling Error : " + string(err.Error()))
+	}
+	return shim.Success(PageAsBytes)
+}
+
+//=====================================================================================
+//rebuildIndexes backfills the index entries and the statistics of the preferences stored before
+//them, a preference already counted in the statistics is not counted again.
+//Arguments [startKey], the MSISDN keys from startKey are indexed up to the configured maxbatch
+//and the response holds the startKey of the next call, empty when all keys are indexed.
+//Pagination is not available in a write transaction, so the range is bounded by the count
+//=====================================================================================
+
+func (dlp *CPM) rebuildIndexes(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) > 1 {
+		return shim.Error("rebuildIndexes : Incorrect number of arguments, Expected 0 or 1 [startKey]")
+	}
+	startKey := ""
+	if len(args) == 1 {
+		startKey = args[0]
+	}
+	config, err := getConfig(stub)
+	if err != nil {
+		logger.Errorf("rebuildIndexes : GetState Failed for Config Error : " + string(err.Error()))
+		return shim.Error("rebuildIndexes : GetState Failed for Config Error : " + string(err.Error()))
+	}
+	organization, err := getOrganization(stub)
+	if err != nil {
+		logger.Errorf("rebuildIndexes : Getting certificate Details Error : " + string(err.Error()))
+		return shim.Error("rebuildIndexes : Getting certificate Details Error : " + string(err.Error()))
+	}
+	if !isRegulator(config, organization) {
+		logger.Errorf("Unauthorized Access")
+		return shim.Error("Unauthorized Access")
+	}
+	resultsIterator, err := stub.GetStateByRange(startKey, "")
+	if err != nil {
+		logger.Errorf("rebuildIndexes : GetStateByRange Failed Error : " + string(err.Error()))
+		return shim.Error("rebuildIndexes : GetStateByRange Failed Error : " + string(err.Error()))
+	}
+	defer resultsIterator.Close()
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		logger.Errorf("rebuildIndexes : Getting Transaction Timestamp Error : " + string(err.Error()))
+		return shim.Error("rebuildIndexes : Getting Transaction Timestamp Error : " + string(err.Error()))
+	}
+	indexed := 0
+	scanned := 0
+	nextKey := ""
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			logger.Errorf("rebuildIndexes : Iterator Error : " + string(err.Error()))
+			return shim.Error("rebuildIndexes : Iterator Error : " + string(err.Error()))
+		}
+		if scanned == config.MaxBatchSize {
+			nextKey = queryResponse.Key
+			break
+		}
+		scanned = scanned + 1
+		preference := &Preference{}
+		if err := json.Unmarshal(queryResponse.Value, preference); err != nil || preference.ObjType != "Preferences" || isChurnedRecord(queryResponse.Value) {
+			continue
+		}
+		if err := updatePreferenceIndexes(stub, nil, preference); err != nil {
+			logger.Errorf("rebuildIndexes : Index Update Failed for MSISDN : " + queryResponse.Key + " , Error : " + string(err.Error()))
+			return shim.Error("rebuildIndexes : Index Update Failed for MSISDN : " + queryResponse.Key + " , Error : " + string(err.Error()))
+		}
+		counted, err := isStatCounted(stub, queryResponse.Key)
+		if err != nil {
+			logger.Errorf("rebuildIndexes : GetState Failed for Statistics of MSISDN : " + queryResponse.Key + " , Error : " + string(err.Error()))
+			return shim.Error("rebuildIndexes : GetState Failed for Statistics of MSISDN : " + queryResponse.Key + " , Error : " + string(err.Error()))
+		}
+		if !counted {
+			if err := updatePreferenceStats(stub, nil, preference, txTime); err != nil {
+				logger.Errorf("rebuildIndexes : Statistics Update Failed for MSISDN : " + queryResponse.Key + " , Error : " + string(err.Error()))
+				return shim.Error("rebuildIndexes : Statistics Update Failed for MSISDN : " + queryResponse.Key + " , Error : " + string(err.Error()))
+			}
+		}
+		indexed = indexed + 1
+	}
+	logger.Infof("rebuildIndexes : Indexed " + strconv.Itoa(indexed) + " of " + strconv.Itoa(scanned) + " keys from " + startKey)
+	RebuildAsBytes, err := json.Marshal(IndexRebuild{Indexed: indexed, Scanned: scanned, NextKey: nextKey})
+	if err != nil {
+		logger.Errorf("rebuildIndexes : Marshalling Error : " + string(err.Error()))
+		return shim.Error("rebuildIndexes : Marshalling Error : " + string(err.Error()))
+	}
+	return shim.Success(RebuildAsBytes)
+}
@@ -0,0 +1,97 @@
+/*
+Copyright Tanla Solutions Ltd. 2019 All Rights Reserved.
+Bulk existence and ownership lookup of MSISDNs for customer care
+and porting systems, read key by key without rich queries.
+*/
+
+package main
+
+import (
+	"encoding/json" //reading and writing JSON
+
+	"github.com/hyperledger/fabric/core/chaincode/shim" // import for Chaincode Interface
+	pb "github.com/hyperledger/fabric/protos/peer"      // import for peer response
+)
+
+//Ownership Structure for the existence and ownership of an MSISDN. Operator is the organization owning
+//the preference, Status is churned for the MSISDNs churned and not reallocated and Errors lists why an MSISDN is invalid
+type Ownership struct {
+	Phone           string     `json:"msisdn"`
+	Exists          bool       `json:"exists"`
+	Operator        string     `json:"uby,omitempty"`
+	ServiceProvider string     `json:"svcprv,omitempty"`
+	Lrn             string     `json:"lrn,omitempty"`
+	UpdateTs        string     `json:"uts,omitempty"`
+	Status          string     `json:"status,omitempty"`
+	Errors          []RowError `json:"errors,omitempty"`
+}
+
+//lookupOwnership returns the existence and ownership of the MSISDN from its stored record
+func lookupOwnership(stub shim.ChaincodeStubInterface, msisdn string) (*Ownership, error) {
+	ownership := &Ownership{Phone: msisdn}
+	if rowErrors := validateMsisdn(msisdn); len(rowErrors) > 0 {
+		ownership.Errors = rowErrors
+		return ownership, nil
+	}
+	value, err := stub.GetState(msisdn)
+	if err != nil {
+		return ownership, err
+	}
+	churned, err := isChurnedNumber(stub, msisdn, value)
+	if err != nil {
+		return nil, err
+	}
+	if churned {
+		ownership.Status = PREFCHURNED
+		return ownership, nil
+	}
+	if value == nil {
+		return ownership, nil
+	}
+	preference := Preference{}
+	if err := json.Unmarshal(value, &preference); err != nil {
+		return nil, err
+	}
+	ownership.Exists = true
+	ownership.Operator = preference.UpdatedBy
+	ownership.ServiceProvider = preference.ServiceProvider
+	ownership.Lrn = preference.Lrn
+	ownership.UpdateTs = preference.UpdateTs
+	return ownership, nil
+}
+
+//=====================================================================================
+//lookupPreferences for the existence and ownership of many MSISDNs at once.
+//Arguments [msisdn, msisdn, ...], up to the configured maxbatch MSISDNs in the
+//order of the arguments. The response is bounded by the arguments and is not paged
+//=====================================================================================
+
+func (dlp *CPM) lookupPreferences(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) == 0 {
+		return shim.Error("lookupPreferences : Incorrect number of arguments, Expected atleast 1 [msisdn]")
+	}
+	config, err := getConfig(stub)
+	if err != nil {
+		logger.Errorf("lookupPreferences : GetState Failed for Config Error : " + string(err.Error()))
+		return shim.Error("lookupPreferences : GetState Failed for Config Error : " + string(err.Error()))
+	}
+	if len(args) > config.MaxBatchSize {
+		logger.Errorf("lookupPreferences : " + batchTooLargeResp(len(args), config))
+		return shim.Error(batchTooLargeResp(len(args), config))
+	}
+	ownerships := []*Ownership{}
+	for _, msisdn := range args {
+		ownership, err := lookupOwnership(stub, msisdn)
+		if err != nil {
+			logger.Errorf("lookupPreferences : GetState Failed for MSISDN : " + msisdn + " , Error : " + string(err.Error()))
+			return shim.Error("lookupPreferences : GetState Failed for MSISDN : " + msisdn + " , Error : " + string(err.Error()))
+		}
+		ownerships = append(ownerships, ownership)
+	}
+	OwnershipsAsBytes, err := json.Marshal(ownerships)
+	if err != nil {
+		logger.Errorf("lookupPreferences : Marshalling Error : " + string(err.Error()))
+		return shim.Error("lookupPreferences : Marshalling Error : " + string(err.Error()))
+	}
+	return shim.Success(OwnershipsAsBytes)
+}
@@ -0,0 +1,269 @@
+/*
+Copyright Tanla Solutions Ltd. 2019 All Rights Reserved.
+LRN registry of the operators. A preference carries an LRN of
+the operator writing it and a port the LRN of the recipient
+operator, both checked against the registry. A port hands the
+MSISDN over to the organization of the recipient LRN.
+*/
+
+package main
+
+import (
+	"encoding/json" //reading and writing JSON
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim" // import for Chaincode Interface
+	pb "github.com/hyperledger/fabric/protos/peer"      // import for peer response
+)
+
+//Event Names
+const EVTREGISTERLRN = "REGISTER-LRN"
+
+//Composite Key Object Types, the attribute of the service provider binding is the service provider code
+const KEYLRN = "LRN"
+const KEYSVCPRV = "SVCPRV"
+
+//LRN Status values
+const LRNACTIVE = "active"
+const LRNINACTIVE = "inactive"
+
+//Error Codes
+const ERRLRNNOTREGISTERED = "LRN_NOT_REGISTERED"
+const ERRLRNNOTOWNED = "LRN_NOT_OWNED"
+const ERRSVCPRVNOTOWNED = "SVCPRV_NOT_OWNED"
+
+//=========================================================================================================
+// LrnRecord structure, an LRN registered for an operator. Operator is the organization the LRN belongs to,
+// ServiceProvider its service provider code and Circle the circle or LSA the LRN routes to
+//=========================================================================================================
+type LrnRecord struct {
+	ObjType         string `json:"obj"`
+	Lrn             string `json:"lrn"`
+	Operator        string `json:"opr"`
+	ServiceProvider string `json:"svcprv"`
+	Circle          string `json:"lsa"`
+	Status          string `json:"status"`
+	RegisteredBy    string `json:"rby"`
+	CreateTs        string `json:"cts"`
+	UpdateTs        string `json:"uts"`
+}
+
+//getLrn reads the registered LRN, nil is returned when it is not registered
+func getLrn(stub shim.ChaincodeStubInterface, lrn string) (*LrnRecord, error) {
+	key, err := stub.CreateCompositeKey(KEYLRN, []string{lrn})
+	if err != nil {
+		return nil, err
+	}
+	value, err := stub.GetState(key)
+	if err != nil || value == nil {
+		return nil, err
+	}
+	record := &LrnRecord{}
+	if err := json.Unmarshal(value, record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+//getServiceProviderOperator reads the organization the service provider code is bound to, empty when it is not bound
+func getServiceProviderOperator(stub shim.ChaincodeStubInterface, serviceProvider string) (string, error) {
+	key, err := stub.CreateCompositeKey(KEYSVCPRV, []string{serviceProvider})
+	if err != nil {
+		return "", err
+	}
+	value, err := stub.GetState(key)
+	return string(value), err
+}
+
+//validateLrn checks that the LRN is registered and active and returns its record. A non empty operator shall
+//be the organization of the LRN, a non empty service provider its service provider code bound to that
+//organization, a nil RowError is returned for a valid LRN
+func validateLrn(stub shim.ChaincodeStubInterface, lrn string, operator string, serviceProvider string) (*LrnRecord, *RowError, error) {
+	record, err := getLrn(stub, lrn)
+	if err != nil {
+		return nil, nil, err
+	}
+	if record == nil || record.Status != LRNACTIVE {
+		return nil, &RowError{Code: ERRLRNNOTREGISTERED, Message: "LRN " + lrn + " is not registered or not active"}, nil
+	}
+	if operator != "" && strings.Compare(record.Operator, operator) != 0 {
+		return nil, &RowError{Code: ERRLRNNOTOWNED, Message: "LRN " + lrn + " is registered to another operator"}, nil
+	}
+	if serviceProvider != "" {
+		bound, err := getServiceProviderOperator(stub, serviceProvider)
+		if err != nil {
+			return nil, nil, err
+		}
+		if strings.Compare(record.ServiceProvider, serviceProvider) != 0 || strings.Compare(bound, record.Operator) != 0 {
+			return nil, &RowError{Code: ERRLRNNOTOWNED, Message: "LRN " + lrn + " is not registered to the recipient operator"}, nil
+		}
+	}
+	return record, nil, nil
+}
+
+//lrnErrorResp is the error response of an invalid LRN
+func lrnErrorResp(rowError *RowError) string {
+	return "{\"Error\":\"" + rowError.Message + " \",\"Code\":\"" + rowError.Code + "\"}"
+}
+
+//=====================================================================================
+//registerLrn for registering a new LRN or updating an existing one. An operator
+//registers the LRNs of its own organization, the regulator those of any operator.
+//The service provider code of an LRN is bound to its organization by the first
+//registration of the regulator, an operator registers LRNs only under the service
+//provider codes bound to it
+//=====================================================================================
+
+func (dlp *CPM) registerLrn(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		jsonResp := "{\"lrn\":\"value\",\"svcprv\":\"value\",\"lsa\":\"value\",\"status\":\"active|inactive\",\"opr\":\"value, regulator only\"}"
+		logger.Errorf("registerLrn : Incorrect Number Of Arguments, Expected json structure : " + jsonResp)
+		return shim.Error("registerLrn : Incorrect Number Of Arguments, Expected json structure : " + jsonResp)
+	}
+	input := LrnRecord{}
+	if err := json.Unmarshal([]byte(args[0]), &input); err != nil {
+		logger.Errorf("registerLrn : Input arguments unmarhsaling Error : " + string(err.Error()))
+		return shim.Error("registerLrn : Input arguments unmarhsaling Error : " + string(err.Error()))
+	}
+	if _, err := strconv.Atoi(input.Lrn); err != nil {
+		return shim.Error("{\"Error\":\"LRN is not numeric \"}")
+	}
+	if input.ServiceProvider == "" || input.Circle == "" {
+		return shim.Error("{\"Error\":\"svcprv and lsa are mandatory \"}")
+	}
+	if input.Status == "" {
+		input.Status = LRNACTIVE
+	}
+	if input.Status != LRNACTIVE && input.Status != LRNINACTIVE {
+		return shim.Error("{\"Error\":\"status shall be active or inactive \"}")
+	}
+	organization, err := getOrganization(stub)
+	if err != nil {
+		logger.Errorf("registerLrn : Getting certificate Details Error : " + string(err.Error()))
+		return shim.Error("registerLrn : Getting certificate Details Error : " + string(err.Error()))
+	}
+	config, err := getConfig(stub)
+	if err != nil {
+		logger.Errorf("registerLrn : GetState Failed for Config Error : " + string(err.Error()))
+		return shim.Error("registerLrn : GetState Failed for Config Error : " + string(err.Error()))
+	}
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		logger.Errorf("registerLrn : Getting Transaction Timestamp Error : " + string(err.Error()))
+		return shim.Error("registerLrn : Getting Transaction Timestamp Error : " + string(err.Error()))
+	}
+	regulator := isRegulator(config, organization)
+	if input.Operator == "" {
+		input.Operator = organization
+	}
+	if !regulator && strings.Compare(input.Operator, organization) != 0 {
+		logger.Errorf("Unauthorized Access")
+		return shim.Error("Unauthorized Access")
+	}
+	existing, err := getLrn(stub, input.Lrn)
+	if err != nil {
+		logger.Errorf("registerLrn : GetState Failed for LRN : " + input.Lrn + " , Error : " + string(err.Error()))
+		return shim.Error("registerLrn : GetState Failed for LRN : " + input.Lrn + " , Error : " + string(err.Error()))
+	}
+	bound, err := getServiceProviderOperator(stub, input.ServiceProvider)
+	if err != nil {
+		logger.Errorf("registerLrn : GetState Failed for Service Provider : " + input.ServiceProvider + " , Error : " + string(err.Error()))
+		return shim.Error("registerLrn : GetState Failed for Service Provider : " + input.ServiceProvider + " , Error : " + string(err.Error()))
+	}
+	if bound == "" && !regulator {
+		return shim.Error("{\"Error\":\"svcprv " + input.ServiceProvider + " is not bound to the operator, its first LRN is registered by the regulator \",\"Code\":\"" + ERRSVCPRVNOTOWNED + "\"}")
+	}
+	if bound != "" && strings.Compare(bound, input.Operator) != 0 {
+		return shim.Error("{\"Error\":\"svcprv " + input.ServiceProvider + " is bound to another operator \",\"Code\":\"" + ERRSVCPRVNOTOWNED + "\"}")
+	}
+	if bound == "" {
+		bindingKey, err := stub.CreateCompositeKey(KEYSVCPRV, []string{input.ServiceProvider})
+		if err != nil {
+			logger.Errorf("registerLrn : Composite Key Creation Error : " + string(err.Error()))
+			return shim.Error("registerLrn : Composite Key Creation Error : " + string(err.Error()))
+		}
+		if err := stub.PutState(bindingKey, []byte(input.Operator)); err != nil {
+			logger.Errorf("registerLrn : PutState Failed for Service Provider Error : " + string(err.Error()))
+			return shim.Error("registerLrn : PutState Failed for Service Provider Error : " + string(err.Error()))
+		}
+	}
+	LrnStruct := &LrnRecord{}
+	LrnStruct.ObjType = "Lrn"
+	LrnStruct.Lrn = input.Lrn
+	LrnStruct.Operator = input.Operator
+	LrnStruct.ServiceProvider = input.ServiceProvider
+	LrnStruct.Circle = input.Circle
+	LrnStruct.Status = input.Status
+	LrnStruct.RegisteredBy = organization
+	LrnStruct.CreateTs = formatTime(txTime)
+	LrnStruct.UpdateTs = formatTime(txTime)
+	if existing != nil {
+		//An LRN is moved to another operator by the regulator only
+		if !regulator && strings.Compare(existing.Operator, organization) != 0 {
+			logger.Errorf("Unauthorized Access")
+			return shim.Error("Unauthorized Access")
+		}
+		LrnStruct.CreateTs = existing.CreateTs
+	}
+	LrnAsBytes, err := json.Marshal(LrnStruct)
+	if err != nil {
+		logger.Errorf("registerLrn : Marshalling Error : " + string(err.Error()))
+		return shim.Error("registerLrn : Marshalling Error : " + string(err.Error()))
+	}
+	key, err := stub.CreateCompositeKey(KEYLRN, []string{LrnStruct.Lrn})
+	if err != nil {
+		logger.Errorf("registerLrn : Composite Key Creation Error : " + string(err.Error()))
+		return shim.Error("registerLrn : Composite Key Creation Error : " + string(err.Error()))
+	}
+	err = stub.PutState(key, LrnAsBytes)
+	if err != nil {
+		logger.Errorf("registerLrn : PutState Failed Error : " + string(err.Error()))
+		return shim.Error("registerLrn : PutState Failed Error : " + string(err.Error()))
+	}
+	err = publishEvent(stub, EVTREGISTERLRN, LrnAsBytes)
+	if err != nil {
+		logger.Errorf("registerLrn : Event Creation Error for EventID : " + string(EVTREGISTERLRN))
+		return shim.Error("registerLrn : Event Creation Error for EventID : " + string(EVTREGISTERLRN))
+	}
+	logger.Infof("registerLrn : PutState Success : " + string(LrnAsBytes))
+	return shim.Success([]byte("registerLrn : LRN registered Successfully : " + LrnStruct.Lrn + " , TransactionID : " + stub.GetTxID()))
+}
+
+//=====================================================================================
+//queryLrn for the registry records of LRNs. Arguments [lrn, lrn, ...], up to the
+//configured maxbatch LRNs, the LRNs that are not registered are left out. The response
+//is bounded by the arguments and is not paged
+//=====================================================================================
+
+func (dlp *CPM) queryLrn(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) == 0 {
+		return shim.Error("queryLrn : Incorrect number of arguments, Expected atleast 1 [lrn]")
+	}
+	config, err := getConfig(stub)
+	if err != nil {
+		logger.Errorf("queryLrn : GetState Failed for Config Error : " + string(err.Error()))
+		return shim.Error("queryLrn : GetState Failed for Config Error : " + string(err.Error()))
+	}
+	if len(args) > config.MaxBatchSize {
+		logger.Errorf("queryLrn : " + batchTooLargeResp(len(args), config))
+		return shim.Error(batchTooLargeResp(len(args), config))
+	}
+	records := []*LrnRecord{}
+	for _, lrn := range args {
+		record, err := getLrn(stub, lrn)
+		if err != nil {
+			logger.Errorf("queryLrn : GetState Failed for LRN : " + lrn + " , Error : " + string(err.Error()))
+			return shim.Error("queryLrn : GetState Failed for LRN : " + lrn + " , Error : " + string(err.Error()))
+		}
+		if record != nil {
+			records = append(records, record)
+		}
+	}
+	RecordsAsBytes, err := json.Marshal(records)
+	if err != nil {
+		logger.Errorf("queryLrn : Marshalling Error : " + string(err.Error()))
+		return shim.Error("queryLrn : Marshalling Error : " + string(err.Error()))
+	}
+	return shim.Success(RecordsAsBytes)
+}
@@ -0,0 +1,228 @@
+/*
+Copyright Tanla Solutions Ltd. 2019 All Rights Reserved.
+Bulk port-out of MSISDNs from the completed ports of the MNP
+clearing house settlement files.
+*/
+
+package main
+
+import (
+	"encoding/json" //reading and writing JSON
+	"strconv"
+	"strings"
+
+	"github.com/beerumicroservice/blockChain/events"    // import for Batch Event payload
+	"github.com/hyperledger/fabric/core/chaincode/shim" // import for Chaincode Interface
+	pb "github.com/hyperledger/fabric/protos/peer"      // import for peer response
+)
+
+//Event Names
+const EVTBATCHPORTOUT = "BATCH-PORT-OUT"
+
+//portFields are the keys expected in a port instruction json, svcprv is the recipient
+//operator, lrn the recipient LRN and eff the effective time of the port
+var portFields = []string{"msisdn", "svcprv", "lrn", "portid", "eff"}
+
+//parsePortRow unmarshals a port instruction json and validates its fields and format
+func parsePortRow(raw string) (map[string]string, []RowError) {
+	var input map[string]interface{}
+	if err := json.Unmarshal([]byte(raw), &input); err != nil {
+		return nil, []RowError{{Code: ERRINVALIDJSON, Message: err.Error()}}
+	}
+	var rowErrors []RowError
+	data := make(map[string]string)
+	for _, field := range portFields {
+		value, ok := input[field].(string)
+		if !ok || strings.TrimSpace(value) == "" {
+			rowErrors = append(rowErrors, RowError{Code: ERRMISSINGFIELD, Message: field + " is missing or not a string"})
+			continue
+		}
+		data[field] = value
+	}
+	for field := range input {
+		if _, ok := data[field]; !ok && !containsField(portFields, field) {
+			rowErrors = append(rowErrors, RowError{Code: ERRUNKNOWNFIELD, Message: field + " is not a port instruction field"})
+		}
+	}
+	if msisdn, ok := data["msisdn"]; ok {
+		rowErrors = append(rowErrors, validateMsisdn(msisdn)...)
+	}
+	if lrn, ok := data["lrn"]; ok {
+		if _, err := strconv.Atoi(lrn); err != nil {
+			rowErrors = append(rowErrors, RowError{Code: ERRLRNNOTNUMERIC, Message: "LRN is not numeric"})
+		}
+	}
+	if eff, ok := data["eff"]; ok {
+		if _, err := parseTime(eff); err != nil {
+			rowErrors = append(rowErrors, RowError{Code: ERRTIMENOTNUMERIC, Message: "eff is not numeric"})
+		}
+	}
+	return data, rowErrors
+}
+
+//======================================================
+//batchPortOut for applying the completed ports of a settlement file.
+//Arguments [mode?, port json, port json, ...], the optional mode is
+//atomic or besteffort (default). As in portOut every MSISDN is ported
+//only by its current owner, the recipient operator and LRN replace the
+//current ones and the organization of the LRN becomes the owner. The LRN
+//shall be registered and active for the recipient.
+//When an MSISDN appears in several valid rows the rows are checked from
+//the last one back, the last row passing the recipient and LRN checks is
+//applied, the earlier rows are skipped as collapsed into it and the later
+//ones rejected with the errors of their checks. Every port is kept in
+//the port history and the ported rows are published in a single
+//BATCH-PORT-OUT event
+//=======================================================
+
+func (dlp *CPM) batchPortOut(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	mode := BATCHBESTEFFORT
+	if len(args) > 0 && (args[0] == BATCHATOMIC || args[0] == BATCHBESTEFFORT) {
+		mode = args[0]
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		logger.Errorf("batchPortOut : Incorrect Number Of Arguments, Expected atleast 1 [port json]")
+		return shim.Error("batchPortOut : Incorrect Number Of Arguments, Expected atleast 1 [port json]")
+	}
+	organization, err := getOrganization(stub)
+	if err != nil {
+		logger.Errorf("batchPortOut : Getting certificate Details Error : " + string(err.Error()))
+		return shim.Error("batchPortOut : Getting certificate Details Error : " + string(err.Error()))
+	}
+	config, err := getConfig(stub)
+	if err != nil {
+		logger.Errorf("batchPortOut : GetState Failed for Config Error : " + string(err.Error()))
+		return shim.Error("batchPortOut : GetState Failed for Config Error : " + string(err.Error()))
+	}
+	if len(args) > config.MaxBatchSize {
+		logger.Errorf("batchPortOut : " + batchTooLargeResp(len(args), config))
+		return shim.Error(batchTooLargeResp(len(args), config))
+	}
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		logger.Errorf("batchPortOut : Getting Transaction Timestamp Error : " + string(err.Error()))
+		return shim.Error("batchPortOut : Getting Transaction Timestamp Error : " + string(err.Error()))
+	}
+	report := BatchReport{Txid: stub.GetTxID(), Mode: mode, Rows: []RowReport{}}
+	var items []events.BatchItem
+	rows := make([]map[string]string, len(args))
+	reports := make([]RowReport, len(args))
+	groups := make(map[string][]int)
+	for i := 0; i < len(args); i++ {
+		logger.Debugf("batchPortOut : Row " + strconv.Itoa(i) + " : " + args[i])
+		var rowErrors []RowError
+		rows[i], rowErrors = parsePortRow(args[i])
+		reports[i] = RowReport{Row: i, Phone: rows[i]["msisdn"], Outcome: OUTCOMEREJECTED, Errors: rowErrors}
+		if len(rowErrors) == 0 {
+			groups[rows[i]["msisdn"]] = append(groups[rows[i]["msisdn"]], i)
+		}
+	}
+	//The rows of an MSISDN are resolved together at its last valid row
+	for i := 0; i < len(args); i++ {
+		group := groups[reports[i].Phone]
+		if len(reports[i].Errors) != 0 || group[len(group)-1] != i {
+			continue
+		}
+		phone := reports[i].Phone
+		value, err := stub.GetState(phone)
+		if err != nil {
+			logger.Errorf("batchPortOut : GetState Failed for MSISDN : " + phone + " , Error : " + string(err.Error()))
+			return shim.Error("batchPortOut : GetState Failed for MSISDN : " + phone + " , Error : " + string(err.Error()))
+		}
+		if value == nil || isChurnedRecord(value) {
+			logger.Debug("batchPortOut : No Existing preferences for MSISDN : " + phone)
+			for _, j := range group {
+				reports[j].Outcome = OUTCOMESKIPPED
+				reports[j].Errors = append(reports[j].Errors, RowError{Code: ERRNOTFOUND, Message: "No Existing preferences for MSISDN"})
+			}
+			continue
+		}
+		PrfStruct := &Preference{}
+		if err := json.Unmarshal(value, PrfStruct); err != nil {
+			logger.Errorf("batchPortOut : Existing prefernce data Unmarhsaling Error : " + string(err.Error()))
+			return shim.Error("batchPortOut : Existing prefernce data Unmarhsaling Error : " + string(err.Error()))
+		}
+		if strings.Compare(PrfStruct.UpdatedBy, organization) != 0 {
+			logger.Errorf("batchPortOut : Unauthorized Access for MSISDN : " + phone)
+			for _, j := range group {
+				reports[j].Errors = append(reports[j].Errors, RowError{Code: ERRUNAUTHORIZED, Message: "MSISDN is owned by another operator"})
+			}
+			continue
+		}
+		applied := -1
+		var recipient *LrnRecord
+		for k := len(group) - 1; k >= 0 && applied < 0; k-- {
+			data := rows[group[k]]
+			if strings.Compare(PrfStruct.ServiceProvider, data["svcprv"]) == 0 {
+				reports[group[k]].Errors = append(reports[group[k]].Errors, RowError{Code: ERRSAMEOPERATOR, Message: "MSISDN is already served by the recipient operator"})
+				continue
+			}
+			lrn, rowError, err := validateLrn(stub, data["lrn"], "", data["svcprv"])
+			if err != nil {
+				logger.Errorf("batchPortOut : GetState Failed for LRN : " + data["lrn"] + " , Error : " + string(err.Error()))
+				return shim.Error("batchPortOut : GetState Failed for LRN : " + data["lrn"] + " , Error : " + string(err.Error()))
+			}
+			if rowError != nil {
+				reports[group[k]].Errors = append(reports[group[k]].Errors, *rowError)
+				continue
+			}
+			applied, recipient = group[k], lrn
+		}
+		if applied < 0 {
+			continue
+		}
+		collapseRows(reports, group, applied)
+		reports[applied].Outcome = OUTCOMEPORTED
+		data := rows[applied]
+		previous := *PrfStruct
+		PrfStruct.ServiceProvider = data["svcprv"]
+		PrfStruct.Lrn = data["lrn"]
+		PrfStruct.PortID = data["portid"]
+		PrfStruct.UpdateTs = data["eff"]
+		PrfStruct.UpdatedBy = recipient.Operator
+		PrfStruct.Pending = portPending(previous.Pending, PrfStruct)
+		PrfAsBytes, err := json.Marshal(PrfStruct)
+		if err != nil {
+			logger.Errorf("batchPortOut : Marshalling Error : " + string(err.Error()))
+			return shim.Error("batchPortOut : Marshalling Error : " + string(err.Error()))
+		}
+		//Inserting DataBlock to BlockChain
+		err = stub.PutState(PrfStruct.Phone, PrfAsBytes)
+		if err != nil {
+			logger.Errorf("batchPortOut : PutState Failed Error : " + string(err.Error()))
+			return shim.Error("batchPortOut : PutState Failed Error : " + string(err.Error()))
+		}
+		logger.Debugf("batchPortOut : PutState Success : " + string(PrfAsBytes))
+		err = trackPreferenceWrite(stub, &previous, PrfStruct)
+		if err != nil {
+			logger.Errorf("batchPortOut : Index and Statistics Update Failed for MSISDN : " + phone + " , Error : " + string(err.Error()))
+			return shim.Error("batchPortOut : Index and Statistics Update Failed for MSISDN : " + phone + " , Error : " + string(err.Error()))
+		}
+		err = recordPort(stub, &previous, PrfStruct, organization, txTime)
+		if err != nil {
+			logger.Errorf("batchPortOut : Port History Update Failed for MSISDN : " + phone + " , Error : " + string(err.Error()))
+			return shim.Error("batchPortOut : Port History Update Failed for MSISDN : " + phone + " , Error : " + string(err.Error()))
+		}
+		items = append(items, newBatchItem(PrfStruct.Phone, OUTCOMEPORTED, PrfAsBytes))
+	}
+	for _, row := range reports {
+		report.add(row)
+	}
+	err = publishBatchEvent(stub, config, EVTBATCHPORTOUT, items)
+	if err != nil {
+		logger.Errorf("batchPortOut : Event Creation Error for EventID : " + string(EVTBATCHPORTOUT) + " , Error : " + string(err.Error()))
+		return shim.Error("batchPortOut : Event Creation Error for EventID : " + string(EVTBATCHPORTOUT) + " , Error : " + string(err.Error()))
+	}
+	ReportAsBytes, err := json.Marshal(report)
+	if err != nil {
+		logger.Errorf("batchPortOut : Report Marshalling Error : " + string(err.Error()))
+		return shim.Error("batchPortOut : Report Marshalling Error : " + string(err.Error()))
+	}
+	logger.Infof("batchPortOut : Ported Count is " + strconv.Itoa(report.Summary.Ported))
+	if report.Summary.Rejected != 0 && mode == BATCHATOMIC {
+		logger.Errorf("batchPortOut : Atomic batch rejected, no MSISDN is ported")
+		return shim.Error(string(ReportAsBytes))
+	}
+	return shim.Success(ReportAsBytes)
+}
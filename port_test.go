@@ -0,0 +1,102 @@
+/*
+Copyright Tanla Solutions Ltd. 2019 All Rights Reserved.
+Tests of the bulk port-out against shim.MockStub
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim" // import for Chaincode Interface
+)
+
+//portRow returns the port instruction json of the MSISDN to Vodafone, the fields given replace the defaults
+func portRow(msisdn string, fields ...string) string {
+	data := map[string]string{"msisdn": msisdn, "svcprv": "VI", "lrn": "4444", "portid": "P" + msisdn, "eff": "1556083755"}
+	for i := 0; i+1 < len(fields); i += 2 {
+		data[fields[i]] = fields[i+1]
+	}
+	RowAsBytes, _ := json.Marshal(data)
+	return string(RowAsBytes)
+}
+
+func TestBatchPortOut(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		status   int32
+		outcomes []string
+		codes    []string
+		ported   []string
+	}{
+		{"port to the recipient LRN", []string{portRow("9199528201"), portRow("9199528202")},
+			shim.OK, []string{OUTCOMEPORTED, OUTCOMEPORTED}, []string{"", ""}, []string{"9199528201", "9199528202"}},
+		{"recipient is the current operator", []string{portRow("9199528201", "svcprv", "AI", "lrn", "3333")},
+			shim.OK, []string{OUTCOMEREJECTED}, []string{ERRSAMEOPERATOR}, nil},
+		{"LRN of another operator", []string{portRow("9199528201", "lrn", "3333")},
+			shim.OK, []string{OUTCOMEREJECTED}, []string{ERRLRNNOTOWNED}, nil},
+		{"LRN not registered", []string{portRow("9199528201", "lrn", "5555")},
+			shim.OK, []string{OUTCOMEREJECTED}, []string{ERRLRNNOTREGISTERED}, nil},
+		{"MSISDN of another operator", []string{portRow("9199528203", "svcprv", "AI", "lrn", "3333"), portRow("9199528201")},
+			shim.OK, []string{OUTCOMEREJECTED, OUTCOMEPORTED}, []string{ERRUNAUTHORIZED, ""}, []string{"9199528201"}},
+		{"MSISDN without preferences", []string{portRow("9199528209")},
+			shim.OK, []string{OUTCOMESKIPPED}, []string{ERRNOTFOUND}, nil},
+		{"a failing correction falls back to the previous row", []string{portRow("9199528201"), portRow("9199528201", "svcprv", "AI", "lrn", "3333")},
+			shim.OK, []string{OUTCOMEPORTED, OUTCOMEREJECTED}, []string{"", ERRSAMEOPERATOR}, []string{"9199528201"}},
+		{"atomic writes nothing on a rejected row", []string{BATCHATOMIC, portRow("9199528201"), portRow("9199528202", "lrn", "3333")},
+			shim.ERROR, []string{OUTCOMEPORTED, OUTCOMEREJECTED}, []string{"", ERRLRNNOTOWNED}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stub := newTestStub(t)
+			for _, setup := range []struct {
+				organization string
+				row          string
+			}{
+				{"Jio", preferenceRow("9199528201")},
+				{"Jio", preferenceRow("9199528202")},
+				{"Vodafone", preferenceRow("9199528203", "svcprv", "VI", "lrn", "4444")},
+			} {
+				if response := stub.invoke(t, setup.organization, "abp", setup.row); response.Status != shim.OK {
+					t.Fatal(response.Message)
+				}
+			}
+			response := stub.invoke(t, "Jio", "bpo", test.args...)
+			if response.Status != test.status {
+				t.Fatalf("status %d, expected %d : %s", response.Status, test.status, response.Message)
+			}
+			if test.ported != nil && (stub.event == nil || stub.event.EventName != EVTBATCHPORTOUT) {
+				t.Errorf("event %v, expected %s", stub.event, EVTBATCHPORTOUT)
+			}
+			report := batchReportOf(t, response)
+			if len(report.Rows) != len(test.outcomes) {
+				t.Fatalf("%d rows reported, expected %d", len(report.Rows), len(test.outcomes))
+			}
+			codes := rowCodes(report)
+			for i, row := range report.Rows {
+				if row.Outcome != test.outcomes[i] || codes[i] != test.codes[i] {
+					t.Errorf("row %d %s %s, expected %s %s", i, row.Outcome, codes[i], test.outcomes[i], test.codes[i])
+				}
+			}
+			for _, msisdn := range []string{"9199528201", "9199528202"} {
+				expected := false
+				for _, ported := range test.ported {
+					expected = expected || ported == msisdn
+				}
+				preference := stub.committed(t, msisdn)
+				ported := preference.UpdatedBy == "Vodafone" && preference.ServiceProvider == "VI" && preference.Lrn == "4444"
+				if ported != expected {
+					t.Errorf("MSISDN %s ported %v, expected %v : %+v", msisdn, ported, expected, preference)
+				}
+				if !ported && (preference.UpdatedBy != "Jio" || preference.ServiceProvider != "AI" || preference.Lrn != "3333") {
+					t.Errorf("MSISDN %s changed without a port : %+v", msisdn, preference)
+				}
+			}
+			if preference := stub.committed(t, "9199528203"); preference.UpdatedBy != "Vodafone" || preference.ServiceProvider != "VI" {
+				t.Errorf("MSISDN of another operator changed : %+v", preference)
+			}
+		})
+	}
+}
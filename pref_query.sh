@@ -1,5 +1,7 @@
 #!/bin/bash
+#Reads the preferences of an MSISDN, after a port-out svcprv and lrn are the recipient ones
+#and uby is the recipient organization now owning the MSISDN
 . setpeer.sh Airtel peer0 
 export CHANNEL_NAME="preferencechannel"
-peer chaincode invoke -o orderer.ucc.net:7050 --tls $CORE_PEER_TLS_ENABLED --cafile $ORDERER_CA -C $CHANNEL_NAME -n pref -c '{"Args":["qp","{\"selector\":{\"obj\":\"Preferences\",\"msisdn\":\"9199528280\"}, \"use_index\" :\"preferencesSearchBymsisdn\"}"]}'
+peer chaincode invoke -o orderer.ucc.net:7050 --tls $CORE_PEER_TLS_ENABLED --cafile $ORDERER_CA -C $CHANNEL_NAME -n pref -c '{"Args":["gq","{\"msisdn\":\"9199528280\"}"]}'
 
@@ -0,0 +1,22 @@
+#!/bin/bash
+#Iterates all pages of a preference rich query with qpp and prints the records of every page
+#Raw query strings are run for the regulator organization only
+#A ported MSISDN is found under the recipient svcprv and lrn, its uby is the recipient organization
+#Usage : ./pref_query_pages.sh [Query String] [Page Size]
+. setpeer.sh Airtel peer0 
+export CHANNEL_NAME="preferencechannel"
+QUERY=${1:-'{"selector":{"obj":"Preferences","svcprv":"AI"}}'}
+PAGESIZE=${2:-100}
+BOOKMARK=""
+while : ; do
+  ARGS=$(jq -cn --arg q "$QUERY" --arg p "$PAGESIZE" --arg b "$BOOKMARK" '{"Args":["qpp",$q,$p,$b]}')
+  PAGE=$(peer chaincode query -C $CHANNEL_NAME -n pref -c "$ARGS") || exit 1
+  echo "$PAGE" | jq -c '.Records[]'
+  COUNT=$(echo "$PAGE" | jq -r '.ResponseMetadata.FetchedCount')
+  BOOKMARK=$(echo "$PAGE" | jq -r '.ResponseMetadata.Bookmark')
+  TRUNCATED=$(echo "$PAGE" | jq -r '.ResponseMetadata.Truncated')
+  #A page truncated at the maxqb byte limit is continued by its bookmark whatever its count
+  if [ "$TRUNCATED" != "true" ] && { [ "$COUNT" -lt "$PAGESIZE" ] || [ -z "$BOOKMARK" ]; }; then
+    break
+  fi
+done
@@ -8,7 +8,6 @@ and portOut the MSISDN on Successful Certificate verification.
 package main
 
 import (
-	"bytes"
 	"encoding/json" //reading and writing JSON
 	"strconv"       //import for msisdn validation
 	"strings"
@@ -27,12 +26,6 @@ const EVTUPDATEPREFERENCES = "UPDATE-PREFERENCES"
 const EVTDELPREFERENCES = "DELETE-PREFERENCES"
 const EVTPORTOUT = "PORT-OUT"
 
-//Output Structure for the output response
-type Output struct {
-	Data         string `json:"data"`
-	ErrorDetails string `json:"error"`
-}
-
 //Event Payload Structure
 type Event struct {
 	Data string `json:"data"`
@@ -44,22 +37,31 @@ type CPM struct {
 }
 
 //=========================================================================================================
-// Preference structure, with 13 properties.  Structure tags are used by encoding/json library
+// Preference structure, with 19 properties.  Structure tags are used by encoding/json library
+// Pending holds a change that is not in effect yet, EffectiveFrom is the time the preference takes effect
+// PortID is the clearing house reference of the last bulk port of the MSISDN
+// Status is churned for the tombstone left by a churn-out, Churn records who churned it, why and when
 //=========================================================================================================
 type Preference struct {
-	ObjType           string `json:"obj"`
-	Phone             string `json:"msisdn"`
-	ServiceProvider   string `json:"svcprv"`
-	RequestNumber     string `json:"reqno"`
-	RegistrationMode  string `json:"rmode"`
-	Category          string `json:"ctgr"`
-	CommunicationMode string `json:"cmode"`
-	DayType           string `json:"day"`
-	DayTimeBand       string `json:"time"`
-	Lrn               string `json:"lrn"`
-	UpdateTs          string `json:"uts"`
-	CreateTs          string `json:"cts"`
-	UpdatedBy         string `json:"uby"`
+	ObjType           string      `json:"obj"`
+	Phone             string      `json:"msisdn"`
+	ServiceProvider   string      `json:"svcprv"`
+	RequestNumber     string      `json:"reqno"`
+	RegistrationMode  string      `json:"rmode"`
+	Category          string      `json:"ctgr"`
+	CommunicationMode string      `json:"cmode"`
+	DayType           string      `json:"day"`
+	DayTimeBand       string      `json:"time"`
+	Lrn               string      `json:"lrn"`
+	UpdateTs          string      `json:"uts"`
+	CreateTs          string      `json:"cts"`
+	UpdatedBy         string      `json:"uby"`
+	EffectiveFrom     string      `json:"eff"`
+	LastChangeTs      string      `json:"lcts"`
+	Pending           *Preference `json:"pending,omitempty"`
+	PortID            string      `json:"portid,omitempty"`
+	Status            string      `json:"status,omitempty"`
+	Churn             *Tombstone  `json:"churn,omitempty"`
 }
 
 //=========================================================================================================
@@ -68,6 +70,21 @@ type Preference struct {
 //=========================================================================================================
 
 func (c *CPM) Init(stub shim.ChaincodeStubInterface) pb.Response {
+	_, args := stub.GetFunctionAndParameters()
+	//Optional argument [regulator organization] stored in the chaincode configuration
+	if len(args) > 0 && args[0] != "" {
+		config, err := getConfig(stub)
+		if err != nil {
+			logger.Errorf("Init : GetState Failed for Config Error : " + string(err.Error()))
+			return shim.Error("Init : GetState Failed for Config Error : " + string(err.Error()))
+		}
+		config.RegulatorOrg = args[0]
+		if _, err := putConfig(stub, config); err != nil {
+			logger.Errorf("Init : PutState Failed for Config Error : " + string(err.Error()))
+			return shim.Error("Init : PutState Failed for Config Error : " + string(err.Error()))
+		}
+		logger.Info("Init : Regulator Organization is " + args[0])
+	}
 	logger.Info("###### Preferences-Chaincode is Initialized #######")
 	return shim.Success(nil)
 }
@@ -89,17 +106,87 @@ func (dlp *CPM) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 		return dlp.portOut(stub, args)
 	case "qp": //Rich Query to retrieve the Preferences from DL
 		return dlp.queryPreferences(stub, args)
+	case "qpp": //Rich Query to retrieve the Preferences from DL page by page
+		return dlp.queryPreferencesWithPagination(stub, args)
+	case "gq": //guarded query of the Preferences by an allow-listed shape
+		return dlp.guardedQuery(stub, args)
+	case "qsr": //Preferences of an MSISDN number series
+		return dlp.querySeries(stub, args)
+	case "qst": //Preference counts folded from the statistics deltas
+		return dlp.queryStatistics(stub, args)
+	case "qix": //Preferences of an index value without rich queries
+		return dlp.queryPreferencesByIndex(stub, args)
+	case "rst": //roll the statistics deltas of a past date up into totals
+		return dlp.rollupStatistics(stub, args)
+	case "rix": //backfill the indexes and statistics of the stored Preferences
+		return dlp.rebuildIndexes(stub, args)
+	case "gp": //preference of an MSISDN in effect at a time
+		return dlp.getPreference(stub, args)
+	case "rtm": //register or update a telemarketer
+		return dlp.registerTelemarketer(stub, args)
+	case "btm": //bind an entity to a chain of telemarketers
+		return dlp.bindTelemarketers(stub, args)
+	case "vtm": //verify the telemarketer chain of an entity
+		return dlp.verifyTelemarketers(stub, args)
+	case "rc": //register a UCC complaint
+		return dlp.registerComplaint(stub, args)
+	case "qc": //retrieve a complaint by complaint ID
+		return dlp.queryComplaint(stub, args)
+	case "tc": //move a complaint to its next state
+		return dlp.transitComplaint(stub, args)
+	case "qsla": //complaints breaching or about to breach their SLA
+		return dlp.queryComplaintSLA(stub, args)
+	case "scfg": //update the chaincode configuration
+		return dlp.setConfig(stub, args)
+	case "gcfg": //retrieve the chaincode configuration
+		return dlp.getConfiguration(stub, args)
+	case "qss": //status of senders from the valid complaint tally
+		return dlp.querySenderStatus(stub, args)
+	case "bdp": //bulk deletion of churned MSISDNs
+		return dlp.batchDelPreferences(stub, args)
+	case "bpo": //bulk port-out from MNP settlement files
+		return dlp.batchPortOut(stub, args)
+	case "vsp", "vabp", "vdp", "vpo": //dry run of sp, abp, dp and po without writing
+		return dlp.dryRun(stub, function[1:], args)
+	case "qcp": //audit query of churned MSISDN tombstones
+		return dlp.queryChurnedPreferences(stub, args)
+	case "ppr": //purge churned MSISDN tombstones after the retention
+		return dlp.purgePreferences(stub, args)
+	case "rn": //reallocate a churned MSISDN to a new subscriber
+		return dlp.reallocateNumber(stub, args)
+	case "qap": //preferences of the previous subscribers of an MSISDN
+		return dlp.queryArchivedPreferences(stub, args)
+	case "qbe": //complete batch event stored for a transaction
+		return dlp.queryBatchEvent(stub, args)
+	case "qol": //existence and ownership of many MSISDNs
+		return dlp.lookupPreferences(stub, args)
+	case "qph": //port history and ownership timeline of an MSISDN
+		return dlp.queryPortHistory(stub, args)
+	case "qop": //MSISDNs ported in or out of a service provider in a date range
+		return dlp.queryOperatorPorts(stub, args)
+	case "rl": //register or update an LRN of an operator
+		return dlp.registerLrn(stub, args)
+	case "ql": //registry records of LRNs
+		return dlp.queryLrn(stub, args)
 	default:
-		logger.Errorf("Unknown Function Invoked, Available Function argument shall be any one of : sp,abp,dp,po,qp")
-		return shim.Error("Available Functions: sp,abp,DP,po,qp")
+		logger.Errorf("Unknown Function Invoked, Available Function argument shall be any one of : sp,abp,dp,po,qp,qpp,gq,qsr,qix,rix,qst,rst,gp,rtm,btm,vtm,rc,qc,tc,qsla,scfg,gcfg,qss,bdp,bpo,vsp,vabp,vdp,vpo,qcp,ppr,rn,qap,qbe,qol,qph,qop,rl,ql")
+		return shim.Error("Available Functions: sp,abp,dp,po,qp,qpp,gq,qsr,qix,rix,qst,rst,gp,rtm,btm,vtm,rc,qc,tc,qsla,scfg,gcfg,qss,bdp,bpo,vsp,vabp,vdp,vpo,qcp,ppr,rn,qap,qbe,qol,qph,qop,rl,ql")
 	}
 }
 
-//setPreferences - Setting new preference or updating existing preference
+//preferenceStructure is the input json expected by setPreferences
+const preferenceStructure = "{\"msisdn\":\"value\",\"svcprv\":\"value\",\"reqno\":\"value\",\"rmode\":\"value\",\"ctgr\":\"value\",\"cmode\":\"value\",\"day\":\"value\",\"time\":\"value\",\"lrn\":\"value\",\"uts\":\"value\",\"cts\":\"value\"}"
+
+//setPreferences - Setting new preference or updating existing preference, the response
+//states the time the preference takes effect after the processing window
 // ==============================================================================
 func (dlp *CPM) setPreferences(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	var jsonResp string
 	var data map[string]interface{}
+	if len(args) != 1 {
+		logger.Errorf("setPreferences : Incorrect Number Of Arguments, Expected json structure : " + preferenceStructure)
+		return shim.Error("setPreferences : Incorrect Number Of Arguments, Expected json structure : " + preferenceStructure)
+	}
 	err := json.Unmarshal([]byte(args[0]), &data)
 
 	logger.Infof("data %v", data)
@@ -108,11 +195,28 @@ func (dlp *CPM) setPreferences(stub shim.ChaincodeStubInterface, args []string)
 		logger.Errorf("setPreferences : Input arguments unmarhsaling Error : " + string(err.Error()))
 		return shim.Error("setPreferences : Input arguments unmarhsaling Error : " + string(err.Error()))
 	}
+	//The fields are read with unchecked assertions below
+	for _, field := range preferenceFields {
+		if _, ok := data[field].(string); !ok {
+			logger.Errorf("setPreferences : " + field + " is missing or not a string, Expected json structure : " + preferenceStructure)
+			return shim.Error("setPreferences : " + field + " is missing or not a string, Expected json structure : " + preferenceStructure)
+		}
+	}
 	certData, err := cid.GetX509Certificate(stub)
 	if err != nil {
 		logger.Errorf("setPreferences : Getting certificate Details Error : " + string(err.Error()))
 		return shim.Error("setPreferences : Getting certificate Details Error : " + string(err.Error()))
 	}
+	config, err := getConfig(stub)
+	if err != nil {
+		logger.Errorf("setPreferences : GetState Failed for Config Error : " + string(err.Error()))
+		return shim.Error("setPreferences : GetState Failed for Config Error : " + string(err.Error()))
+	}
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		logger.Errorf("setPreferences : Getting Transaction Timestamp Error : " + string(err.Error()))
+		return shim.Error("setPreferences : Getting Transaction Timestamp Error : " + string(err.Error()))
+	}
 
 	if _, err := strconv.Atoi(data["msisdn"].(string)); err != nil {
 		jsonResp = "{\"Error\":\"MSISDN is not numeric \"}"
@@ -132,8 +236,27 @@ func (dlp *CPM) setPreferences(stub shim.ChaincodeStubInterface, args []string)
 		logger.Errorf("setPreferences : GetState Failed for MSISDN : " + data["msisdn"].(string) + " Error : " + string(err.Error()))
 		return shim.Error("setPreferences : GetState Failed for MSISDN : " + data["msisdn"].(string) + " Error : " + string(err.Error()))
 	}
+	//A churned MSISDN takes a new preference only after rn has reallocated it, also once its tombstone is purged
+	churned, err := isChurnedNumber(stub, data["msisdn"].(string), value)
+	if err != nil {
+		logger.Errorf("setPreferences : GetState Failed for Churn of MSISDN : " + data["msisdn"].(string) + " Error : " + string(err.Error()))
+		return shim.Error("setPreferences : GetState Failed for Churn of MSISDN : " + data["msisdn"].(string) + " Error : " + string(err.Error()))
+	}
+	if churned {
+		logger.Errorf("setPreferences : " + numberChurnedResp)
+		return shim.Error(numberChurnedResp)
+	}
 	if value == nil {
 		if len(data) == 11 {
+			_, rowError, err := validateLrn(stub, data["lrn"].(string), Organizations[0], "")
+			if err != nil {
+				logger.Errorf("setPreferences : GetState Failed for LRN : " + data["lrn"].(string) + " Error : " + string(err.Error()))
+				return shim.Error("setPreferences : GetState Failed for LRN : " + data["lrn"].(string) + " Error : " + string(err.Error()))
+			}
+			if rowError != nil {
+				logger.Errorf("setPreferences : " + lrnErrorResp(rowError))
+				return shim.Error(lrnErrorResp(rowError))
+			}
 			PrfStruct := &Preference{}
 			PrfStruct.ObjType = "Preferences"
 			PrfStruct.Phone = data["msisdn"].(string)
@@ -148,6 +271,7 @@ func (dlp *CPM) setPreferences(stub shim.ChaincodeStubInterface, args []string)
 			PrfStruct.UpdateTs = data["uts"].(string)
 			PrfStruct.CreateTs = data["cts"].(string)
 			PrfStruct.UpdatedBy = Organizations[0]
+			PrfStruct = schedulePreference(nil, PrfStruct, config, txTime)
 			logger.Infof("msisdn is " + PrfStruct.Phone)
 			PrfAsBytes, err := json.Marshal(PrfStruct)
 			if err != nil {
@@ -161,6 +285,11 @@ func (dlp *CPM) setPreferences(stub shim.ChaincodeStubInterface, args []string)
 				return shim.Error("setPreferences : PutState Failed Error : " + string(err.Error()))
 			}
 			logger.Infof("setPreferences : PutState Success : " + string(PrfAsBytes))
+			err = trackPreferenceWrite(stub, nil, PrfStruct)
+			if err != nil {
+				logger.Errorf("setPreferences : Index and Statistics Update Failed for MSISDN : " + PrfStruct.Phone + " , Error : " + string(err.Error()))
+				return shim.Error("setPreferences : Index and Statistics Update Failed for MSISDN : " + PrfStruct.Phone + " , Error : " + string(err.Error()))
+			}
 			//Txid := stub.GetTxID()
 			eventbytes := Event{Data: string(PrfAsBytes), Txid: stub.GetTxID()}
 			payload, err := json.Marshal(eventbytes)
@@ -175,9 +304,9 @@ func (dlp *CPM) setPreferences(stub shim.ChaincodeStubInterface, args []string)
 			}
 			logger.Infof("setPreferences : Event Payload data : " + string(payload))
 			txid := stub.GetTxID()
-			return shim.Success([]byte("setPreferences : Preferences data added Successfully for MSISDN : " + PrfStruct.Phone + " , TransactionID      " + txid))
+			return shim.Success([]byte("setPreferences : Preferences data added Successfully for MSISDN : " + PrfStruct.Phone + " , takes effect at " + takesEffectAt(PrfStruct) + " , TransactionID      " + txid))
 		} else {
-			jsonResp = "{\"msisdn\":\"value\",\"svcprv\":\"value\",\"reqno\":\"value\",\"rmode\":\"value\",\"ctgr\":\"value\",\"cmode\":\"value\",\"day\":\"value\",\"time\":\"value\",\"lrn\":\"value\",\"uts\":\"value\",\"cts\":\"value\"}"
+			jsonResp = preferenceStructure
 			logger.Errorf("setPreferences : Incorrect Number Of Arguments, Expected json structure : " + string(jsonResp))
 			return shim.Error("setPreferences : Incorrect Number Of Arguments, Expected json structure : " + string(jsonResp))
 		}
@@ -194,6 +323,19 @@ func (dlp *CPM) setPreferences(stub shim.ChaincodeStubInterface, args []string)
 			orgName = preference.UpdatedBy
 			organizationName = Organizations[0]
 			if strings.Compare(orgName, organizationName) == 0 {
+				if isChangeTooSoon(&preference, config, txTime) {
+					logger.Errorf("setPreferences : " + changeTooSoonResp)
+					return shim.Error(changeTooSoonResp)
+				}
+				_, rowError, err := validateLrn(stub, data["lrn"].(string), Organizations[0], "")
+				if err != nil {
+					logger.Errorf("setPreferences : GetState Failed for LRN : " + data["lrn"].(string) + " Error : " + string(err.Error()))
+					return shim.Error("setPreferences : GetState Failed for LRN : " + data["lrn"].(string) + " Error : " + string(err.Error()))
+				}
+				if rowError != nil {
+					logger.Errorf("setPreferences : " + lrnErrorResp(rowError))
+					return shim.Error(lrnErrorResp(rowError))
+				}
 				PrfStruct := &Preference{}
 				PrfStruct.ObjType = "Preferences"
 				PrfStruct.Phone = data["msisdn"].(string)
@@ -208,6 +350,7 @@ func (dlp *CPM) setPreferences(stub shim.ChaincodeStubInterface, args []string)
 				PrfStruct.UpdateTs = data["uts"].(string)
 				PrfStruct.CreateTs = data["cts"].(string)
 				PrfStruct.UpdatedBy = Organizations[0]
+				PrfStruct = schedulePreference(&preference, PrfStruct, config, txTime)
 				logger.Infof("msisdn is " + PrfStruct.Phone)
 				PrfAsBytes, err := json.Marshal(PrfStruct)
 				if err != nil {
@@ -221,6 +364,11 @@ func (dlp *CPM) setPreferences(stub shim.ChaincodeStubInterface, args []string)
 					return shim.Error("setPreferences : PutState Failed Error : " + string(err.Error()))
 				}
 				logger.Infof("setPreferences : PutState Success : " + string(PrfAsBytes))
+				err = trackPreferenceWrite(stub, &preference, PrfStruct)
+				if err != nil {
+					logger.Errorf("setPreferences : Index and Statistics Update Failed for MSISDN : " + PrfStruct.Phone + " , Error : " + string(err.Error()))
+					return shim.Error("setPreferences : Index and Statistics Update Failed for MSISDN : " + PrfStruct.Phone + " , Error : " + string(err.Error()))
+				}
 				eventbytes := Event{Data: string(PrfAsBytes), Txid: stub.GetTxID()}
 				payload, err := json.Marshal(eventbytes)
 				if err != nil {
@@ -234,251 +382,42 @@ func (dlp *CPM) setPreferences(stub shim.ChaincodeStubInterface, args []string)
 				}
 				logger.Infof("Event published data: " + string(payload))
 				txid := stub.GetTxID()
-				return shim.Success([]byte("setPreferences : Preference data updated  successfully for MSISDN : " + PrfStruct.Phone + " , TransactionID      " + txid))
+				return shim.Success([]byte("setPreferences : Preference data updated  successfully for MSISDN : " + PrfStruct.Phone + " , takes effect at " + takesEffectAt(PrfStruct) + " , TransactionID      " + txid))
 			} else {
 				logger.Errorf("Unauthorized Access")
 				return shim.Error("Unauthorized Access")
 
 			}
 		} else {
-			jsonResp = "{\"msisdn\":\"value\",\"svcprv\":\"value\",\"reqno\":\"value\",\"rmode\":\"value\",\"ctgr\":\"value\",\"cmode\":\"value\",\"day\":\"value\",\"time\":\"value\",\"lrn\":\"value\",\"uts\":\"value\",\"cts\":\"value\"}"
+			jsonResp = preferenceStructure
 			logger.Errorf("setPreferences : Incorrect Number Of Arguments, Expected json structure : " + string(jsonResp))
 			return shim.Error("setPreferences : Incorrect Number Of Arguments, Expected json structure : " + string(jsonResp))
 		}
 	}
 }
 
-//======================================================
-//batchPreferences for Uploading Bulk Preferences into DL
-//=======================================================
-
-func (dlp *CPM) batchPreferences(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	var jsonResp string
-	var result []string
-	var errorCount int
-	errorCount = 0
-	for i := 0; i < len(args); i++ {
-		var errorCheck int
-		var data map[string]interface{}
-		errorCheck = 0
-		logger.Infof(args[i])
-		err := json.Unmarshal([]byte(args[i]), &data)
-		if err != nil {
-			logger.Errorf("batchPreferences : Input arguments unmarhsaling Error : " + string(err.Error()))
-			return shim.Error("batchPreferences : Input arguments unmarhsaling Error : " + string(err.Error()))
-		}
-		certData, err := cid.GetX509Certificate(stub)
-		if err != nil {
-			logger.Errorf("batchPreferences : Getting certificate Details Error : " + string(err.Error()))
-			return shim.Error("batchPreferences : Getting certificate Details Error : " + string(err.Error()))
-		}
-		Organizations := certData.Issuer.Organization
-		if _, err := strconv.Atoi(data["msisdn"].(string)); err != nil {
-			out := Output{Data: data["msisdn"].(string), ErrorDetails: "MobileNumber Contains Only Numeric Characters,It is Not Numeric"}
-			edata, err := json.Marshal(out)
-			if err != nil {
-				logger.Errorf("batchPreferences : Marshalling Error : " + string(err.Error()))
-				return shim.Error("batchPreferences : Marshalling Error : " + string(err.Error()))
-			}
-			result = append(result, string(edata))
-			errorCount = errorCount + 1
-			errorCheck = errorCheck + 1
-		}
-		if len(data["msisdn"].(string)) < 10 {
-			out := Output{Data: data["msisdn"].(string), ErrorDetails: "MobileNumber is not Valid Length"}
-			edata, err := json.Marshal(out)
-			if err != nil {
-				logger.Errorf("batchPreferences : Marshalling Error : " + string(err.Error()))
-				return shim.Error("batchPreferences : Marshalling Error : " + string(err.Error()))
-			}
-			result = append(result, string(edata))
-			errorCount = errorCount + 1
-			errorCheck = errorCheck + 1
-
-		}
-		if _, err := strconv.Atoi(data["lrn"].(string)); err != nil {
-			out := Output{Data: data["lrn"].(string), ErrorDetails: "Lrn Containts Only Numeric Charcters,It is Not Numeric"}
-			edata, err := json.Marshal(out)
-			if err != nil {
-				logger.Errorf("batchPreferences : Marshalling Error : " + string(err.Error()))
-				return shim.Error("batchPreferences : Marshalling Error : " + string(err.Error()))
-			}
-			result = append(result, string(edata))
-			errorCount = errorCount + 1
-			errorCheck = errorCheck + 1
-
-		}
-		if errorCheck != 0 {
-			continue
-		}
-		value, err := stub.GetState(data["msisdn"].(string))
-		if err != nil {
-			logger.Errorf("batchPreferences : GetState Failed for MSISDN : " + data["msisdn"].(string) + " , Error : " + string(err.Error()))
-			return shim.Error("batchPreferences : GetState Failed for MSISDN : " + data["msisdn"].(string) + " , Error : " + string(err.Error()))
-		}
-		if value == nil {
-			if len(data) == 11 {
-				PrfStruct := &Preference{}
-				PrfStruct.ObjType = "Preferences"
-				PrfStruct.Phone = data["msisdn"].(string)
-				PrfStruct.ServiceProvider = data["svcprv"].(string)
-				PrfStruct.RequestNumber = data["reqno"].(string)
-				PrfStruct.RegistrationMode = data["rmode"].(string)
-				PrfStruct.Category = data["ctgr"].(string)
-				PrfStruct.CommunicationMode = data["cmode"].(string)
-				PrfStruct.DayType = data["day"].(string)
-				PrfStruct.DayTimeBand = data["time"].(string)
-				PrfStruct.Lrn = data["lrn"].(string)
-				PrfStruct.UpdateTs = data["uts"].(string)
-				PrfStruct.CreateTs = data["cts"].(string)
-				PrfStruct.UpdatedBy = Organizations[0]
-				logger.Infof("msisdn is " + PrfStruct.Phone)
-				PrfAsBytes, err := json.Marshal(PrfStruct)
-				if err != nil {
-					logger.Errorf("batchPreferences : Marshalling Error : " + string(err.Error()))
-					return shim.Error("batchPreferences : Marshalling Error : " + string(err.Error()))
-				}
-				//Inserting DataBlock to BlockChain
-				err = stub.PutState(PrfStruct.Phone, PrfAsBytes)
-				if err != nil {
-					logger.Errorf("batchPreferences : PutState Failed Error : " + string(err.Error()))
-					return shim.Error("batchPreferences : PutState Failed Error : " + string(err.Error()))
-				}
-				logger.Infof("batchPreferences : PutState Success : " + string(PrfAsBytes))
-				eventbytes := Event{Data: string(PrfAsBytes), Txid: stub.GetTxID()}
-				payload, err := json.Marshal(eventbytes)
-				if err != nil {
-					logger.Errorf("batchPreferences : Event Payload Marshalling Error :" + string(err.Error()))
-					return shim.Error("batchPreferences : Event Payload Marshalling Error :" + string(err.Error()))
-				}
-				err2 := stub.SetEvent(EVTADDPREFERENCES, []byte(payload))
-				if err2 != nil {
-					logger.Errorf("batchPreferences : Event Creation Error for EventID : " + string(EVTADDPREFERENCES))
-					return shim.Error("batchPreferences : Event Creation Error for EventID : " + string(EVTADDPREFERENCES))
-				}
-				logger.Infof("batchPreferences : Event Payload data : " + string(payload))
-			} else {
-				jsonResp = "{\"msisdn\":\"value\",\"svcprv\":\"value\",\"reqno\":\"value\",\"rmode\":\"value\",\"ctgr\":\"value\",\"cmode\":\"value\",\"day\":\"value\",\"time\":\"value\",\"lrn\":\"value\",\"uts\":\"value\",\"cts\":\"value\"}"
-				logger.Errorf("batchPreferences : Incorrect Number Of Arguments, Expected json structure : " + string(jsonResp))
-				out := Output{Data: args[i], ErrorDetails: "IncorrectNumberOfArGumentsExceptin[11 keys]"}
-				edata, err := json.Marshal(out)
-				if err != nil {
-					logger.Errorf("batchPreferences : Marshalling Error : " + string(err.Error()))
-					return shim.Error("batchPreferences : Marshalling Error : " + string(err.Error()))
-				}
-				result = append(result, string(edata))
-				errorCount = errorCount + 1
-				continue
-			}
-		} else {
-
-			if len(data) == 11 {
-				var organizationName string
-				var orgName string
-
-				preference := Preference{}
-				err := json.Unmarshal(value, &preference)
-				if err != nil {
-					logger.Errorf("batchPreferences : Unmarhsaling Error : " + string(err.Error()))
-					return shim.Error("batchPreferences : Unmarhsaling Error : " + string(err.Error()))
-				}
-				orgName = preference.UpdatedBy
-				organizationName = Organizations[0]
-				if strings.Compare(orgName, organizationName) == 0 {
-					PrfStruct := &Preference{}
-					PrfStruct.ObjType = "Preferences"
-					PrfStruct.Phone = data["msisdn"].(string)
-					PrfStruct.ServiceProvider = data["svcprv"].(string)
-					PrfStruct.RequestNumber = data["reqno"].(string)
-					PrfStruct.RegistrationMode = data["rmode"].(string)
-					PrfStruct.Category = data["ctgr"].(string)
-					PrfStruct.CommunicationMode = data["cmode"].(string)
-					PrfStruct.DayType = data["day"].(string)
-					PrfStruct.DayTimeBand = data["time"].(string)
-					PrfStruct.Lrn = data["lrn"].(string)
-					PrfStruct.UpdateTs = data["uts"].(string)
-					PrfStruct.CreateTs = data["cts"].(string)
-					PrfStruct.UpdatedBy = Organizations[0]
-					logger.Infof("msisdn is " + PrfStruct.Phone)
-					PrfAsBytes, err := json.Marshal(PrfStruct)
-					if err != nil {
-						logger.Errorf("batchPreferences : Marshalling Error : " + string(err.Error()))
-						return shim.Error("batchPreferences : Marshalling Error : " + string(err.Error()))
-					}
-					//Inserting DataBlock to BlockChain
-					err = stub.PutState(PrfStruct.Phone, PrfAsBytes)
-					if err != nil {
-						logger.Errorf("batchPreferences : PutState Failed Error : " + string(err.Error()))
-						return shim.Error("batchPreferences : PutState Failed Error : " + string(err.Error()))
-					}
-					logger.Infof("batchPreferences : PutState Success : " + string(PrfAsBytes))
-					eventbytes := Event{Data: string(PrfAsBytes), Txid: stub.GetTxID()}
-					payload, err := json.Marshal(eventbytes)
-					if err != nil {
-						logger.Errorf("batchPreferences : Event Payload Marshalling Error : " + string(err.Error()))
-						return shim.Error("batchPreferences : Event Payload Marshalling Error : " + string(err.Error()))
-					}
-					err2 := stub.SetEvent(EVTUPDATEPREFERENCES, []byte(payload))
-					if err2 != nil {
-						logger.Errorf("batchPreferences : Event Creation Error for EventID : " + string(EVTUPDATEPREFERENCES))
-						return shim.Error("batchPreferences : Event Creation Error for EventID : " + string(EVTUPDATEPREFERENCES))
-					}
-					logger.Infof("Event published data " + string(payload))
-					//txid := stub.GetTxID()
-					//return shim.Success([]byte("batchPreferences : Preferences data added Successfully for MSISDN : " + PrfStruct.Phone + " , TransactionID      " + txid))
-				} else {
-					logger.Errorf("Unauthorized Access")
-					out := Output{Data: args[i], ErrorDetails: "Unaithorized Access"}
-					edata, err := json.Marshal(out)
-					if err != nil {
-						logger.Errorf("batchPreferences : Marshalling Error : " + string(err.Error()))
-						return shim.Error("batchPreferences : Marshalling Error : " + string(err.Error()))
-					}
-					result = append(result, string(edata))
-					errorCount = errorCount + 1
-					continue
-				}
-			} else {
-				jsonResp = "{\"msisdn\":\"value\",\"svcprv\":\"value\",\"reqno\":\"value\",\"rmode\":\"value\",\"ctgr\":\"value\",\"cmode\":\"value\",\"day\":\"value\",\"time\":\"value\",\"lrn\":\"value\",\"uts\":\"value\",\"cts\":\"value\"}"
-				logger.Errorf("batchPreferences : Incorrect Number Of Arguments, Expected json structure : " + string(jsonResp))
-				out := Output{Data: args[i], ErrorDetails: "IncorrectNumberOfArGumentsExceptin[11 keys]"}
-				edata, err := json.Marshal(out)
-				if err != nil {
-					logger.Errorf("batchPreferences : Marshalling Error : " + string(err.Error()))
-					return shim.Error("batchPreferences : Marshalling Error : " + string(err.Error()))
-				}
-				result = append(result, string(edata))
-				errorCount = errorCount + 1
-				continue
-			}
-		}
-	}
-	logger.Infof("ErrorCount is " + string(errorCount))
-	if errorCount == 0 {
-		txid := stub.GetTxID()
-		return shim.Success([]byte("batchPreferences : Batch Preferences data added Successfully. TransactionID : " + txid))
-	} else {
-		response := strings.Join(result, "|")
-		return shim.Success([]byte("batchPreferences : Updating batch Error : " + string(response)))
-	}
-
-}
-
 //=============================================================================================================
 //delPreferences for Removing or to churn out preference from DL based on MSISDN on successful certificate check
 //==============================================================================================================
 
 func (dlp *CPM) delPreferences(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	if len(args) != 1 {
+	if len(args) != 1 && len(args) != 2 {
 		logger.Errorf("delPreferences : Incorrect Number Of Arguments, MSISDN Expected.")
 		return shim.Error("delPreferences : Incorrect Number Of Arguments, MSISDN Expected.")
 	}
+	reason := CHURNDISCONNECTION
+	if len(args) == 2 {
+		reason = args[1]
+	}
+	if !isChurnReason(reason) {
+		return shim.Error(churnReasonResp)
+	}
 	value, err := stub.GetState(args[0])
 	if err != nil {
 		logger.Errorf("delPreferences : GetState Failed for MSISDN : " + string(args[0]) + " , Error : " + string(err.Error()))
 		return shim.Error("delPreferences : GetState Failed for MSISDN :" + string(args[0]) + " , Error : " + string(err.Error()))
 	}
-	if value == nil {
+	if value == nil || isChurnedRecord(value) {
 		logger.Info("delPreferences : No Existing preferences for MSISDN : " + string(args[0]))
 		return shim.Success([]byte("delPreferences : No Existing preferences for MSISDN : " + string(args[0])))
 	} else {
@@ -499,11 +438,39 @@ func (dlp *CPM) delPreferences(stub shim.ChaincodeStubInterface, args []string)
 		orgName = preference.UpdatedBy
 		organizationName = Organizations[0]
 		if strings.Compare(orgName, organizationName) == 0 {
-			err = stub.DelState(args[0])
+			config, err := getConfig(stub)
+			if err != nil {
+				logger.Errorf("delPreferences : GetState Failed for Config Error : " + string(err.Error()))
+				return shim.Error("delPreferences : GetState Failed for Config Error : " + string(err.Error()))
+			}
+			txTime, err := getTxTime(stub)
+			if err != nil {
+				logger.Errorf("delPreferences : Getting Transaction Timestamp Error : " + string(err.Error()))
+				return shim.Error("delPreferences : Getting Transaction Timestamp Error : " + string(err.Error()))
+			}
+			//A deletion asked by the subscriber is a preference change, the operator disconnecting or
+			//porting out the MSISDN is not held to the minimum interval
+			if reason == CHURNSUBSCRIBER && isChangeTooSoon(&preference, config, txTime) {
+				logger.Errorf("delPreferences : " + changeTooSoonResp)
+				return shim.Error(changeTooSoonResp)
+			}
+			//The preference is replaced by its tombstone, purged of the preference by purgePreferences after the retention
+			tombstone := churnPreference(&preference, reason, organizationName, txTime)
+			PrfAsBytes, err := json.Marshal(tombstone)
+			if err != nil {
+				logger.Errorf("delPreferences : Marshalling Error : " + string(err.Error()))
+				return shim.Error("delPreferences : Marshalling Error : " + string(err.Error()))
+			}
+			err = stub.PutState(args[0], PrfAsBytes)
 			if err != nil {
 				logger.Error("delPreferences : Removing Preferences from DLT error for MSISDN " + string(args[0]) + " , Error : " + string(err.Error()))
 				return shim.Error("delPreferences : Removing Preferences from DLT error for MSISDN " + string(args[0]) + " , Error : " + string(err.Error()))
 			}
+			err = trackPreferenceWrite(stub, &preference, tombstone)
+			if err != nil {
+				logger.Errorf("delPreferences : Index and Statistics Update Failed for MSISDN : " + string(args[0]) + " , Error : " + string(err.Error()))
+				return shim.Error("delPreferences : Index and Statistics Update Failed for MSISDN : " + string(args[0]) + " , Error : " + string(err.Error()))
+			}
 			eventbytes := Event{Data: string(args[0]), Txid: stub.GetTxID()}
 			payload, err := json.Marshal(eventbytes)
 			if err != nil {
@@ -528,16 +495,25 @@ func (dlp *CPM) delPreferences(stub shim.ChaincodeStubInterface, args []string)
 
 //=====================================================
 //portOut for Ownership transfer from Donor to acceptor
+//Arguments [msisdn, svcprv, lrn, uts], invoked by the donor
+//owning the MSISDN with the recipient operator and LRN. The
+//recipient LRN is mandatory and shall be registered and active
+//for the acceptor, the organization of the recipient LRN becomes
+//the owner, so that the donor loses the MSISDN and only the
+//acceptor changes its preferences after the port
 //=====================================================
 
 func (dlp *CPM) portOut(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	var jsonResp string
 
 	logger.Infof("data %v", args)
-	logger.Infof("data %v", args[0])
-	if len(args) != 3 {
-		logger.Errorf("portOut : Incorrect number of arguments, Excepted 3 [msisdn,serviceprovide,updatedtime]")
-		return shim.Error("portOut : Incorrect number of arguments, Excepted 3  [msisdn,serviceprovide,updatedtime]")
+	if len(args) == 3 {
+		logger.Errorf("portOut : Recipient LRN is missing, Expected 4 [msisdn, svcprv, lrn, uts], the organization of the LRN becomes the owner")
+		return shim.Error("portOut : Recipient LRN is missing, Expected 4 [msisdn, svcprv, lrn, uts], the organization of the LRN becomes the owner")
+	}
+	if len(args) != 4 {
+		logger.Errorf("portOut : Incorrect number of arguments, Expected 4 [msisdn, svcprv, lrn, uts]")
+		return shim.Error("portOut : Incorrect number of arguments, Expected 4 [msisdn, svcprv, lrn, uts]")
 	}
 	if _, err := strconv.Atoi(args[0]); err != nil {
 		jsonResp = "{\"Error\":\"MSISDN is not numeric \"}"
@@ -548,12 +524,27 @@ func (dlp *CPM) portOut(stub shim.ChaincodeStubInterface, args []string) pb.Resp
 		jsonResp = "{\"Error\":\"MSISDN is not a valid length \"}"
 		return shim.Error(jsonResp)
 	}
+	if _, err := strconv.Atoi(args[2]); err != nil {
+		jsonResp = "{\"Error\":\"LRN is not numeric \"}"
+		return shim.Error(jsonResp)
+	}
+	//The recipient LRN replaces the donor one, so the routing of the ported MSISDN is right on the ledger,
+	//and the organization of the recipient LRN owns the ported MSISDN
+	recipient, rowError, err := validateLrn(stub, args[2], "", args[1])
+	if err != nil {
+		logger.Errorf("portOut : GetState Failed for LRN : " + args[2] + " , Error : " + string(err.Error()))
+		return shim.Error("portOut : GetState Failed for LRN : " + args[2] + " , Error : " + string(err.Error()))
+	}
+	if rowError != nil {
+		logger.Errorf("portOut : " + lrnErrorResp(rowError))
+		return shim.Error(lrnErrorResp(rowError))
+	}
 	value, err := stub.GetState(args[0])
 	if err != nil {
 		logger.Errorf("portOut : GetState Failed for MSISDN : " + string(args[0]) + " , Error : " + string(err.Error()))
 		return shim.Error("portOut : GetState Failed for MSISDN : " + string(args[0]) + " , Error : " + string(err.Error()))
 	}
-	if value == nil {
+	if value == nil || isChurnedRecord(value) {
 		logger.Info("portOut : No Existing preferences for MSISDN : " + string(args[0]))
 		return shim.Success([]byte("portOut : No Existing preferences for MSISDN : " + string(args[0])))
 	} else {
@@ -584,10 +575,13 @@ func (dlp *CPM) portOut(stub shim.ChaincodeStubInterface, args []string) pb.Resp
 			PrfStruct.CommunicationMode = preference.CommunicationMode
 			PrfStruct.DayType = preference.DayType
 			PrfStruct.DayTimeBand = preference.DayTimeBand
-			PrfStruct.Lrn = preference.Lrn
-			PrfStruct.UpdateTs = args[2]
+			PrfStruct.Lrn = args[2]
+			PrfStruct.UpdateTs = args[3]
 			PrfStruct.CreateTs = preference.CreateTs
-			PrfStruct.UpdatedBy = Organizations[0]
+			PrfStruct.UpdatedBy = recipient.Operator
+			PrfStruct.EffectiveFrom = preference.EffectiveFrom
+			PrfStruct.LastChangeTs = preference.LastChangeTs
+			PrfStruct.Pending = portPending(preference.Pending, PrfStruct)
 			logger.Infof("msisdn is " + PrfStruct.Phone)
 			PrfAsBytes, err := json.Marshal(PrfStruct)
 			if err != nil {
@@ -601,6 +595,21 @@ func (dlp *CPM) portOut(stub shim.ChaincodeStubInterface, args []string) pb.Resp
 				return shim.Error("portOut : PutState Failed Error : " + string(err.Error()))
 			}
 			logger.Infof("portOut : PutState Success : " + string(PrfAsBytes))
+			err = trackPreferenceWrite(stub, &preference, PrfStruct)
+			if err != nil {
+				logger.Errorf("portOut : Index and Statistics Update Failed for MSISDN : " + PrfStruct.Phone + " , Error : " + string(err.Error()))
+				return shim.Error("portOut : Index and Statistics Update Failed for MSISDN : " + PrfStruct.Phone + " , Error : " + string(err.Error()))
+			}
+			txTime, err := getTxTime(stub)
+			if err != nil {
+				logger.Errorf("portOut : Getting Transaction Timestamp Error : " + string(err.Error()))
+				return shim.Error("portOut : Getting Transaction Timestamp Error : " + string(err.Error()))
+			}
+			err = recordPort(stub, &preference, PrfStruct, Organizations[0], txTime)
+			if err != nil {
+				logger.Errorf("portOut : Port History Update Failed for MSISDN : " + PrfStruct.Phone + " , Error : " + string(err.Error()))
+				return shim.Error("portOut : Port History Update Failed for MSISDN : " + PrfStruct.Phone + " , Error : " + string(err.Error()))
+			}
 			eventbytes := Event{Data: string(PrfAsBytes), Txid: stub.GetTxID()}
 			payload, err := json.Marshal(eventbytes)
 			if err != nil {
@@ -623,16 +632,47 @@ func (dlp *CPM) portOut(stub shim.ChaincodeStubInterface, args []string) pb.Resp
 }
 
 //======================================================================================
-//queryPreferences RichQuery for Obtaining Preference data
+//queryPreferences RichQuery for Obtaining Preference data, raw selectors are run for the regulator only
+//Arguments [Query String], [Query String, format] or [Query String, format, bookmark], the format is
+//array (default), json, ndjson or csv. The array is refused over the configured maxqb, the bookmark
+//continues a json, ndjson or csv response truncated at maxqb
 //======================================================================================
 
 func (dlp *CPM) queryPreferences(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	if len(args) != 1 {
-		return shim.Error("queryPreferences : Incorrect number of arguments, Expected 1 [Query String]")
+	if len(args) < 1 || len(args) > 3 {
+		return shim.Error("queryPreferences : Incorrect number of arguments, Expected 1 [Query String], 2 [Query String, format] or 3 [Query String, format, bookmark]")
+	}
+	config, err := getConfig(stub)
+	if err != nil {
+		logger.Errorf("queryPreferences : GetState Failed for Config Error : " + string(err.Error()))
+		return shim.Error("queryPreferences : GetState Failed for Config Error : " + string(err.Error()))
+	}
+	regulator, err := callerIsRegulator(stub)
+	if err != nil {
+		logger.Errorf("queryPreferences : Getting Caller Details Error : " + string(err.Error()))
+		return shim.Error("queryPreferences : Getting Caller Details Error : " + string(err.Error()))
+	}
+	if !regulator {
+		logger.Errorf("Unauthorized Access")
+		return shim.Error("Unauthorized Access")
 	}
 	queryString := args[0]
+	format, bookmark := "", ""
+	if len(args) > 1 {
+		format = args[1]
+	}
+	if format == "" {
+		format = FORMATARRAY
+	}
+	if len(args) > 2 {
+		bookmark = args[2]
+	}
+	encoder, _, err := newResultEncoder(format, preferenceColumns, config.MaxQueryBytes, bookmark)
+	if err != nil {
+		return shim.Error("{\"Error\":\"" + err.Error() + " \"}")
+	}
 	logger.Info(args[0])
-	queryResults, err := getQueryResultForQueryString(stub, queryString)
+	queryResults, err := getQueryResultForQueryString(stub, queryString, encoder)
 	if err != nil {
 		logger.Errorf("queryPreferences : getQueryResultForQueryString Failed Error : " + string(err.Error()))
 		return shim.Error("queryPreferences : getQueryResultForQueryString Failed Error : " + string(err.Error()))
@@ -640,61 +680,135 @@ func (dlp *CPM) queryPreferences(stub shim.ChaincodeStubInterface, args []string
 	return shim.Success(queryResults)
 }
 
-func getQueryResultForQueryString(stub shim.ChaincodeStubInterface, queryString string) ([]byte, error) {
+//======================================================================================
+//queryPreferencesWithPagination RichQuery for Obtaining Preference data page by page, for the regulator only
+//Arguments [Query String, Page Size], [Query String, Page Size, Bookmark] or [Query String, Page Size,
+//Bookmark, format], the Bookmark is empty for the first page and the Bookmark of the ResponseMetadata
+//of a page for the next one
+//======================================================================================
+
+func (dlp *CPM) queryPreferencesWithPagination(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 2 || len(args) > 4 {
+		return shim.Error("queryPreferencesWithPagination : Incorrect number of arguments, Expected 2 [Query String, Page Size], 3 [Query String, Page Size, Bookmark] or 4 [Query String, Page Size, Bookmark, format]")
+	}
+	config, err := getConfig(stub)
+	if err != nil {
+		logger.Errorf("queryPreferencesWithPagination : GetState Failed for Config Error : " + string(err.Error()))
+		return shim.Error("queryPreferencesWithPagination : GetState Failed for Config Error : " + string(err.Error()))
+	}
+	regulator, err := callerIsRegulator(stub)
+	if err != nil {
+		logger.Errorf("queryPreferencesWithPagination : Getting Caller Details Error : " + string(err.Error()))
+		return shim.Error("queryPreferencesWithPagination : Getting Caller Details Error : " + string(err.Error()))
+	}
+	if !regulator {
+		logger.Errorf("Unauthorized Access")
+		return shim.Error("Unauthorized Access")
+	}
+	queryString := args[0]
+	pageSize, err := strconv.ParseInt(args[1], 10, 32)
+	if err != nil || pageSize <= 0 {
+		return shim.Error("{\"Error\":\"Page Size is not a positive number \"}")
+	}
+	bookmark, format := "", ""
+	if len(args) > 2 {
+		bookmark = args[2]
+	}
+	if len(args) > 3 {
+		format = args[3]
+	}
+	encoder, bookmark, err := newResultEncoder(format, preferenceColumns, config.MaxQueryBytes, bookmark)
+	if err != nil {
+		return shim.Error("{\"Error\":\"" + err.Error() + " \"}")
+	}
+	logger.Info(args[0])
+	queryResults, err := getQueryResultForQueryStringWithPagination(stub, queryString, int32(pageSize), bookmark, encoder)
+	if err != nil {
+		logger.Errorf("queryPreferencesWithPagination : getQueryResultForQueryStringWithPagination Failed Error : " + string(err.Error()))
+		return shim.Error("queryPreferencesWithPagination : getQueryResultForQueryStringWithPagination Failed Error : " + string(err.Error()))
+	}
+	return shim.Success(queryResults)
+}
+
+func getQueryResultForQueryString(stub shim.ChaincodeStubInterface, queryString string, encoder *resultEncoder) ([]byte, error) {
 	resultsIterator, err := stub.GetQueryResult(queryString)
 	if err != nil {
 		return nil, err
 	}
 	defer resultsIterator.Close()
 
-	buffer, err := constructQueryResponseFromIterator(resultsIterator)
-	if err != nil {
+	if err := encodeResults(resultsIterator, encoder, storedRecord); err != nil {
 		return nil, err
 	}
-	return buffer.Bytes(), nil
+	return encoder.finish("")
 }
 
 // ===========================================================================================
-// constructQueryResponseFromIterator constructs a JSON array containing query results from
-// a given result iterator
+// getQueryResultForQueryStringWithPagination executes the query for a page and returns it in the
+// format of the encoder, with the ResponseMetadata of the page. A page truncated at the byte
+// limit returns the continuation bookmark of the page instead of the bookmark of the next page
 // ===========================================================================================
-func constructQueryResponseFromIterator(resultsIterator shim.StateQueryIteratorInterface) (*bytes.Buffer, error) {
-	// buffer is a JSON array containing QueryResults
-	var buffer bytes.Buffer
-	buffer.WriteString("[")
-
-	bArrayMemberAlreadyWritten := false
-	for resultsIterator.HasNext() {
-		queryResponse, err := resultsIterator.Next()
+func getQueryResultForQueryStringWithPagination(stub shim.ChaincodeStubInterface, queryString string, pageSize int32, bookmark string, encoder *resultEncoder) ([]byte, error) {
+	resultsIterator, responseMetadata, err := stub.GetQueryResultWithPagination(queryString, pageSize, bookmark)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	if err := encodeResults(resultsIterator, encoder, storedRecord); err != nil {
+		return nil, err
+	}
+	return encoder.finish(responseMetadata.Bookmark)
+}
+
+//==================================================================================================
+//getPreferenceAt returns the preference of the MSISDN in effect at the given time from the
+//key history, nil is returned when no preference was in effect at that time
+//==================================================================================================
+
+func getPreferenceAt(stub shim.ChaincodeStubInterface, msisdn string, at int64) (*Preference, error) {
+	historyIterator, err := stub.GetHistoryForKey(msisdn)
+	if err != nil {
+		return nil, err
+	}
+	defer historyIterator.Close()
+
+	var effective *Preference
+	var effectiveTs int64
+	found := false
+	for historyIterator.HasNext() {
+		modification, err := historyIterator.Next()
 		if err != nil {
 			return nil, err
 		}
-		// Add a comma before array members, suppress it for the first array member
-		if bArrayMemberAlreadyWritten == true {
-			buffer.WriteString(",")
+		if modification.Timestamp == nil || modification.Timestamp.Seconds > at {
+			continue
+		}
+		if found && modification.Timestamp.Seconds < effectiveTs {
+			continue
 		}
-		buffer.WriteString("{\"Key\":")
-		buffer.WriteString("\"")
-		buffer.WriteString(queryResponse.Key)
-		buffer.WriteString("\"")
-
-		buffer.WriteString(", \"Record\":")
-		// Record is a JSON object, so we write as-is
-		buffer.WriteString(string(queryResponse.Value))
-		buffer.WriteString("}")
-		bArrayMemberAlreadyWritten = true
+		found = true
+		effectiveTs = modification.Timestamp.Seconds
+		if modification.IsDelete {
+			effective = nil
+			continue
+		}
+		preference := &Preference{}
+		if err := json.Unmarshal(modification.Value, preference); err != nil {
+			return nil, err
+		}
+		effective = preference
 	}
-	buffer.WriteString("]")
-
-	return &buffer, nil
+	return effectivePreference(effective, at), nil
 }
 
 // ===================================================================================
 //main function for the preference ChainCode
 // ===================================================================================
 func main() {
+	//Rows of the batches are logged at debug level, set before Start as Start blocks while the chaincode runs
+	logger.SetLevel(shim.LogInfo)
 	err := shim.Start(new(CPM))
-	logger.SetLevel(shim.LogDebug)
 	if err != nil {
 		logger.Error("Error Starting Cpm Chaincode is " + string(err.Error()))
 	} else {
@@ -0,0 +1,429 @@
+/*
+Copyright Tanla Solutions Ltd. 2019 All Rights Reserved.
+Guarded queries of the preferences. Queries are typed filters that
+the chaincode translates into Mango on a packaged index, capped in
+size. Callers see the full record of the MSISDNs their operator owns
+and the scrub view of the others. Raw selectors are for the regulator.
+*/
+
+package main
+
+import (
+	"encoding/json" //reading and writing JSON
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim" // import for Chaincode Interface
+	pb "github.com/hyperledger/fabric/protos/peer"      // import for peer response
+)
+
+//Query Shapes, shorthands of the typed filters
+const SHAPEMSISDN = "msisdn"
+const SHAPEOPERATOR = "operator"
+const SHAPECATEGORY = "category"
+const SHAPEUPDATED = "updated"
+
+//Sort Orders
+const SORTASC = "asc"
+const SORTDESC = "desc"
+
+//MINSERIESPREFIX is the shortest MSISDN prefix of a guarded query, so a prefix does not span an operator base
+const MINSERIESPREFIX = 6
+
+//queryIndexes are the index design documents of the indexed fields, in META-INF/statedb/couchdb/indexes
+var queryIndexes = map[string]string{
+	"msisdn": "preferencesSearchBymsisdn",
+	"lrn":    "preferencesSearchBylrn",
+	"svcprv": "preferencesSearchBysvcprv",
+	"uby":    "preferencesSearchByuby",
+	"uts":    "preferencesSearchByuts",
+	"ctgr":   "preferencesSearchByctgr",
+}
+
+//indexOrder is the order in which the filters are preferred for the index of a query, most selective first
+var indexOrder = []string{"msisdn", "lrn", "svcprv", "uby", "uts", "ctgr"}
+
+//GuardedQuery Structure for the input of a guarded query. Category and CommunicationMode match the
+//preferences containing the code, From and To bound the update time. Prefix is the MSISDN prefix of a
+//number series as in SeriesQuery. Sort is msisdn or uts, Order asc or desc. Shape and Value are the shorthand of a single filter, kept for the clients of the shapes.
+//Format is the output format of the response, json, ndjson or csv
+type GuardedQuery struct {
+	Phone             string `json:"msisdn"`
+	Prefix            string `json:"prefix"`
+	ServiceProvider   string `json:"svcprv"`
+	Lrn               string `json:"lrn"`
+	Operator          string `json:"operator"`
+	Category          string `json:"ctgr"`
+	CommunicationMode string `json:"cmode"`
+	From              string `json:"from"`
+	To                string `json:"to"`
+	Sort              string `json:"sort"`
+	Order             string `json:"order"`
+	Limit             int32  `json:"limit"`
+	Shape             string `json:"shape"`
+	Value             string `json:"value"`
+	PageSize          int32  `json:"size"`
+	Bookmark          string `json:"bookmark"`
+	Format            string `json:"format"`
+}
+
+//ScrubView Structure for the preference of an MSISDN owned by another operator, only the
+//values needed to scrub traffic towards the MSISDN
+type ScrubView struct {
+	Phone             string `json:"msisdn"`
+	Category          string `json:"ctgr"`
+	CommunicationMode string `json:"cmode"`
+	DayType           string `json:"day"`
+	DayTimeBand       string `json:"time"`
+}
+
+//applyShape sets the filter of the shorthand shape of the query
+func applyShape(query *GuardedQuery) error {
+	switch query.Shape {
+	case "":
+	case SHAPEMSISDN:
+		query.Phone = query.Value
+	case SHAPEOPERATOR:
+		query.Operator = query.Value
+	case SHAPECATEGORY:
+		query.Category = query.Value
+	case SHAPEUPDATED:
+		if query.From == "" || query.To == "" {
+			return errors.New("from and to are required for the updated shape")
+		}
+	default:
+		return errors.New("shape shall be msisdn, operator, category or updated")
+	}
+	if query.Limit <= 0 {
+		query.Limit = query.PageSize
+	}
+	return nil
+}
+
+//parseCode parses a numeric code of a filter, a code shall not be negative
+func parseCode(code string) (int, error) {
+	n, err := strconv.Atoi(code)
+	if err != nil || n < 0 {
+		return 0, errors.New(code + " is not a numeric code")
+	}
+	return n, nil
+}
+
+//codeSelector returns the selector matching a comma separated list of codes containing the code, the
+//expression is built from the parsed code so no input reaches the regular expression
+func codeSelector(code int) map[string]string {
+	return map[string]string{"$regex": "(^|,)" + strconv.Itoa(code) + "(,|$)"}
+}
+
+//buildGuardedQuery validates the query input and translates its filters into a query string on the index
+//of the sort field or else of the most selective filter. The operator filter is limited to the own operator
+//of the caller, unless the caller is the regulator, and so are the LRN and service provider filters. Any
+//other query of an operator is anchored by its own operator, an MSISDN or a number series prefix, so the
+//scrub views of another operator base are not harvested by category, communication mode or update time
+func buildGuardedQuery(query *GuardedQuery, organization string, regulator bool) (string, error) {
+	if err := applyShape(query); err != nil {
+		return "", err
+	}
+	selector := map[string]interface{}{"obj": "Preferences"}
+	if query.Phone != "" {
+		if _, err := strconv.Atoi(query.Phone); err != nil || len(query.Phone) < 10 {
+			return "", errors.New("msisdn shall be a valid MSISDN")
+		}
+		selector["msisdn"] = query.Phone
+	}
+	if query.Prefix != "" {
+		if query.Phone != "" {
+			return "", errors.New("msisdn and prefix shall not be combined")
+		}
+		if strings.Trim(query.Prefix, "0123456789") != "" || len(query.Prefix) < MINSERIESPREFIX {
+			return "", errors.New("prefix shall be numeric with at least " + strconv.Itoa(MINSERIESPREFIX) + " digits")
+		}
+		//MSISDN keys are numeric, so every MSISDN of the series sorts before the prefix followed by ':'
+		selector["msisdn"] = map[string]string{"$gte": query.Prefix, "$lt": query.Prefix + ":"}
+	}
+	if query.Lrn != "" {
+		if _, err := strconv.Atoi(query.Lrn); err != nil {
+			return "", errors.New("lrn shall be numeric")
+		}
+		selector["lrn"] = query.Lrn
+	}
+	if query.ServiceProvider != "" {
+		selector["svcprv"] = query.ServiceProvider
+	}
+	//A competitor base is not paged through by its LRN or service provider code
+	if !regulator && query.Operator == "" && (query.Lrn != "" || query.ServiceProvider != "") {
+		query.Operator = organization
+	}
+	if query.Operator != "" || query.Shape == SHAPEOPERATOR {
+		if query.Operator == "" {
+			query.Operator = organization
+		}
+		if !regulator && strings.Compare(query.Operator, organization) != 0 {
+			return "", errors.New("operator shall be the own operator")
+		}
+		selector["uby"] = query.Operator
+	}
+	if !regulator && query.Operator == "" && query.Phone == "" && query.Prefix == "" {
+		return "", errors.New("operator, msisdn or prefix is required")
+	}
+	if query.From != "" || query.To != "" {
+		window := map[string]string{}
+		if query.From != "" {
+			if _, err := parseTime(query.From); err != nil {
+				return "", errors.New("from shall be numeric")
+			}
+			window["$gte"] = query.From
+		}
+		if query.To != "" {
+			if _, err := parseTime(query.To); err != nil {
+				return "", errors.New("to shall be numeric")
+			}
+			window["$lte"] = query.To
+		}
+		selector["uts"] = window
+	}
+	if query.Category != "" {
+		category, err := parseCode(query.Category)
+		if err != nil {
+			return "", errors.New("ctgr shall be a numeric category")
+		}
+		selector["ctgr"] = codeSelector(category)
+	}
+	if query.CommunicationMode != "" {
+		communicationMode, err := parseCode(query.CommunicationMode)
+		if err != nil {
+			return "", errors.New("cmode shall be a numeric communication mode")
+		}
+		selector["cmode"] = codeSelector(communicationMode)
+	}
+	if query.Order == "" {
+		query.Order = SORTASC
+	}
+	if query.Order != SORTASC && query.Order != SORTDESC {
+		return "", errors.New("order shall be asc or desc")
+	}
+	index := ""
+	mango := map[string]interface{}{"selector": selector}
+	switch query.Sort {
+	case "":
+		for _, field := range indexOrder {
+			if _, ok := selector[field]; ok {
+				index = queryIndexes[field]
+				break
+			}
+		}
+		if index == "" {
+			return "", errors.New("at least one of msisdn, prefix, lrn, svcprv, operator, from, to or ctgr is required")
+		}
+	case "msisdn", "uts":
+		//CouchDB sorts on an index only when the selector holds every field of the index
+		if _, ok := selector[query.Sort]; !ok {
+			selector[query.Sort] = map[string]interface{}{"$gt": nil}
+		}
+		index = queryIndexes[query.Sort]
+		mango["sort"] = []map[string]string{{"obj": query.Order}, {query.Sort: query.Order}}
+	default:
+		return "", errors.New("sort shall be msisdn or uts")
+	}
+	mango["use_index"] = []string{"_design/" + index, index}
+	QueryAsBytes, err := json.Marshal(mango)
+	if err != nil {
+		return "", err
+	}
+	return string(QueryAsBytes), nil
+}
+
+//scrubView returns the scrub view of the preference in effect, nil is returned when none is in effect
+func scrubView(preference *Preference, at int64) *ScrubView {
+	effective := effectivePreference(preference, at)
+	if effective == nil {
+		return nil
+	}
+	return &ScrubView{Phone: effective.Phone, Category: effective.Category, CommunicationMode: effective.CommunicationMode, DayType: effective.DayType, DayTimeBand: effective.DayTimeBand}
+}
+
+//guardRecord returns the stored preference as seen by the caller, the full record for the regulator and
+//the owning operator and the scrub view for the others. nil is returned for tombstones and other records
+func guardRecord(value []byte, organization string, regulator bool, at int64) interface{} {
+	preference := &Preference{}
+	if value == nil || json.Unmarshal(value, preference) != nil || preference.ObjType != "Preferences" || isChurnedRecord(value) {
+		return nil
+	}
+	if regulator || strings.Compare(preference.UpdatedBy, organization) == 0 {
+		return preference
+	}
+	if view := scrubView(preference, at); view != nil {
+		return view
+	}
+	return nil
+}
+
+//=====================================================================================
+//guardedQuery for querying the preferences by typed filters.
+//Arguments [GuardedQuery json], the limit is the page size capped to the configured maxq
+//=====================================================================================
+
+func (dlp *CPM) guardedQuery(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("guardedQuery : Incorrect number of arguments, Expected 1 [Query json]")
+	}
+	query := GuardedQuery{}
+	if err := json.Unmarshal([]byte(args[0]), &query); err != nil {
+		logger.Errorf("guardedQuery : Input arguments unmarhsaling Error : " + string(err.Error()))
+		return shim.Error("guardedQuery : Input arguments unmarhsaling Error : " + string(err.Error()))
+	}
+	organization, err := getOrganization(stub)
+	if err != nil {
+		logger.Errorf("guardedQuery : Getting certificate Details Error : " + string(err.Error()))
+		return shim.Error("guardedQuery : Getting certificate Details Error : " + string(err.Error()))
+	}
+	config, err := getConfig(stub)
+	if err != nil {
+		logger.Errorf("guardedQuery : GetState Failed for Config Error : " + string(err.Error()))
+		return shim.Error("guardedQuery : GetState Failed for Config Error : " + string(err.Error()))
+	}
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		logger.Errorf("guardedQuery : Getting Transaction Timestamp Error : " + string(err.Error()))
+		return shim.Error("guardedQuery : Getting Transaction Timestamp Error : " + string(err.Error()))
+	}
+	regulator := isRegulator(config, organization)
+	//The LRN filter of an operator is resolved through the registry to one of its own LRNs
+	if query.Lrn != "" && !regulator {
+		lrn, err := getLrn(stub, query.Lrn)
+		if err != nil {
+			logger.Errorf("guardedQuery : GetState Failed for LRN : " + query.Lrn + " , Error : " + string(err.Error()))
+			return shim.Error("guardedQuery : GetState Failed for LRN : " + query.Lrn + " , Error : " + string(err.Error()))
+		}
+		if lrn == nil || strings.Compare(lrn.Operator, organization) != 0 {
+			return shim.Error("{\"Error\":\"lrn shall be an LRN of the own operator \",\"Code\":\"" + ERRLRNNOTOWNED + "\"}")
+		}
+	}
+	queryString, err := buildGuardedQuery(&query, organization, regulator)
+	if err != nil {
+		return shim.Error("{\"Error\":\"" + err.Error() + " \"}")
+	}
+	if query.Limit <= 0 || query.Limit > config.MaxQueryResults {
+		query.Limit = config.MaxQueryResults
+	}
+	encoder, bookmark, err := newResultEncoder(query.Format, preferenceColumns, config.MaxQueryBytes, query.Bookmark)
+	if err != nil {
+		return shim.Error("{\"Error\":\"" + err.Error() + " \"}")
+	}
+	logger.Infof("guardedQuery : " + queryString)
+	resultsIterator, responseMetadata, err := stub.GetQueryResultWithPagination(queryString, query.Limit, bookmark)
+	if err != nil {
+		logger.Errorf("guardedQuery : GetQueryResultWithPagination Failed Error : " + string(err.Error()))
+		return shim.Error("guardedQuery : GetQueryResultWithPagination Failed Error : " + string(err.Error()))
+	}
+	defer resultsIterator.Close()
+	err = encodeResults(resultsIterator, encoder, func(key string, value []byte) (string, interface{}, error) {
+		return key, guardRecord(value, organization, regulator, txTime), nil
+	})
+	if err != nil {
+		logger.Errorf("guardedQuery : Iterator Error : " + string(err.Error()))
+		return shim.Error("guardedQuery : Iterator Error : " + string(err.Error()))
+	}
+	PageAsBytes, err := encoder.finish(responseMetadata.Bookmark)
+	if err != nil {
+		logger.Errorf("guardedQuery : Marshalling Error : " + string(err.Error()))
+		return shim.Error("guardedQuery : Marshalling Error : " + string(err.Error()))
+	}
+	return shim.Success(PageAsBytes)
+}
+
+//SeriesQuery Structure for the input of a number series query, the series is given by the MSISDN
+//Prefix or by the Start and End keys, End excluded. Operator filters the series by the owning operator,
+//Format is the output format as in GuardedQuery
+type SeriesQuery struct {
+	Prefix   string `json:"prefix"`
+	Start    string `json:"start"`
+	End      string `json:"end"`
+	Operator string `json:"operator"`
+	PageSize int32  `json:"size"`
+	Bookmark string `json:"bookmark"`
+	Format   string `json:"format"`
+}
+
+//=====================================================================================
+//querySeries for the preferences of an MSISDN number series page by page.
+//Arguments [SeriesQuery json], the page size is capped to the configured maxq and
+//the records are filtered as in guardedQuery
+//=====================================================================================
+
+func (dlp *CPM) querySeries(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return shim.Error("querySeries : Incorrect number of arguments, Expected 1 [Series json]")
+	}
+	query := SeriesQuery{}
+	if err := json.Unmarshal([]byte(args[0]), &query); err != nil {
+		logger.Errorf("querySeries : Input arguments unmarhsaling Error : " + string(err.Error()))
+		return shim.Error("querySeries : Input arguments unmarhsaling Error : " + string(err.Error()))
+	}
+	if query.Prefix != "" {
+		if _, err := strconv.Atoi(query.Prefix); err != nil {
+			return shim.Error("{\"Error\":\"prefix is not numeric \"}")
+		}
+		//MSISDN keys are numeric, so every key of the series sorts before the prefix followed by ':'
+		query.Start = query.Prefix
+		query.End = query.Prefix + ":"
+	}
+	if _, err := strconv.Atoi(query.Start); err != nil {
+		return shim.Error("{\"Error\":\"prefix or start shall be numeric \"}")
+	}
+	if _, err := strconv.Atoi(query.End); err != nil && query.Prefix == "" {
+		return shim.Error("{\"Error\":\"end shall be numeric \"}")
+	}
+	if strings.Compare(query.Start, query.End) >= 0 {
+		return shim.Error("{\"Error\":\"start shall be before end \"}")
+	}
+	organization, err := getOrganization(stub)
+	if err != nil {
+		logger.Errorf("querySeries : Getting certificate Details Error : " + string(err.Error()))
+		return shim.Error("querySeries : Getting certificate Details Error : " + string(err.Error()))
+	}
+	config, err := getConfig(stub)
+	if err != nil {
+		logger.Errorf("querySeries : GetState Failed for Config Error : " + string(err.Error()))
+		return shim.Error("querySeries : GetState Failed for Config Error : " + string(err.Error()))
+	}
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		logger.Errorf("querySeries : Getting Transaction Timestamp Error : " + string(err.Error()))
+		return shim.Error("querySeries : Getting Transaction Timestamp Error : " + string(err.Error()))
+	}
+	regulator := isRegulator(config, organization)
+	if query.PageSize <= 0 || query.PageSize > config.MaxQueryResults {
+		query.PageSize = config.MaxQueryResults
+	}
+	encoder, bookmark, err := newResultEncoder(query.Format, preferenceColumns, config.MaxQueryBytes, query.Bookmark)
+	if err != nil {
+		return shim.Error("{\"Error\":\"" + err.Error() + " \"}")
+	}
+	resultsIterator, responseMetadata, err := stub.GetStateByRangeWithPagination(query.Start, query.End, query.PageSize, bookmark)
+	if err != nil {
+		logger.Errorf("querySeries : GetStateByRangeWithPagination Failed Error : " + string(err.Error()))
+		return shim.Error("querySeries : GetStateByRangeWithPagination Failed Error : " + string(err.Error()))
+	}
+	defer resultsIterator.Close()
+	err = encodeResults(resultsIterator, encoder, func(key string, value []byte) (string, interface{}, error) {
+		if query.Operator != "" {
+			preference := Preference{}
+			if json.Unmarshal(value, &preference) != nil || strings.Compare(preference.UpdatedBy, query.Operator) != 0 {
+				return key, nil, nil
+			}
+		}
+		return key, guardRecord(value, organization, regulator, txTime), nil
+	})
+	if err != nil {
+		logger.Errorf("querySeries : Iterator Error : " + string(err.Error()))
+		return shim.Error("querySeries : Iterator Error : " + string(err.Error()))
+	}
+	PageAsBytes, err := encoder.finish(responseMetadata.Bookmark)
+	if err != nil {
+		logger.Errorf("querySeries : Marshalling Error : " + string(err.Error()))
+		return shim.Error("querySeries : Marshalling Error : " + string(err.Error()))
+	}
+	return shim.Success(PageAsBytes)
+}
@@ -0,0 +1,268 @@
+/*
+Copyright Tanla Solutions Ltd. 2019 All Rights Reserved.
+Reallocation of a churned MSISDN to a new subscriber. The
+preference of the previous subscriber is archived under its
+generation and the current record is reset, so nothing of the
+previous subscriber carries over to the new one.
+*/
+
+package main
+
+import (
+	"encoding/json" //reading and writing JSON
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim" // import for Chaincode Interface
+	pb "github.com/hyperledger/fabric/protos/peer"      // import for peer response
+)
+
+//Event Names
+const EVTREALLOCATED = "NUMBER-REALLOCATED"
+
+//Composite Key Object Types
+const KEYPREFARCHIVE = "PREFARCHIVE"
+const KEYPREFGENERATION = "PREFGEN"
+const KEYPREFCHURN = "PREFCHURN"
+
+//Error Codes
+const ERRQUARANTINE = "NUMBER_IN_QUARANTINE"
+const ERRCHURNED = "NUMBER_CHURNED"
+
+//numberChurnedResp is the error response for a preference written on a churned MSISDN
+const numberChurnedResp = "{\"Error\":\"MSISDN is churned, it is reused only after reallocation \",\"Code\":\"" + ERRCHURNED + "\"}"
+
+//ArchivedPreference Structure for the preference of a previous subscriber of a reallocated MSISDN
+type ArchivedPreference struct {
+	ObjType       string      `json:"obj"`
+	Phone         string      `json:"msisdn"`
+	Generation    int         `json:"gen"`
+	ReallocatedBy string      `json:"rby"`
+	ReallocatedTs string      `json:"rts"`
+	Preference    *Preference `json:"pref"`
+}
+
+//generationKey formats the generation so the archive keys sort in generation order
+func generationKey(generation int) string {
+	return fmt.Sprintf("%06d", generation)
+}
+
+//getGeneration reads the number of subscribers the MSISDN was allocated to before the current one
+func getGeneration(stub shim.ChaincodeStubInterface, msisdn string) (int, error) {
+	key, err := stub.CreateCompositeKey(KEYPREFGENERATION, []string{msisdn})
+	if err != nil {
+		return 0, err
+	}
+	value, err := stub.GetState(key)
+	if err != nil || value == nil {
+		return 0, err
+	}
+	return strconv.Atoi(string(value))
+}
+
+//getPurgedChurn reads the churn kept for an MSISDN whose tombstone is purged, nil is returned when it is not purged
+func getPurgedChurn(stub shim.ChaincodeStubInterface, msisdn string) (*Tombstone, error) {
+	key, err := stub.CreateCompositeKey(KEYPREFCHURN, []string{msisdn})
+	if err != nil {
+		return nil, err
+	}
+	value, err := stub.GetState(key)
+	if err != nil || value == nil {
+		return nil, err
+	}
+	churn := &Tombstone{}
+	if err := json.Unmarshal(value, churn); err != nil {
+		return nil, err
+	}
+	return churn, nil
+}
+
+//putPurgedChurn keeps the churn of an MSISDN whose tombstone is purged, until the MSISDN is reallocated
+func putPurgedChurn(stub shim.ChaincodeStubInterface, msisdn string, churn *Tombstone) error {
+	key, err := stub.CreateCompositeKey(KEYPREFCHURN, []string{msisdn})
+	if err != nil {
+		return err
+	}
+	ChurnAsBytes, err := json.Marshal(churn)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(key, ChurnAsBytes)
+}
+
+//isChurnedNumber checks whether the MSISDN of the stored value is churned, by its tombstone or by the churn
+//kept after the tombstone is purged
+func isChurnedNumber(stub shim.ChaincodeStubInterface, msisdn string, value []byte) (bool, error) {
+	if value != nil {
+		return isChurnedRecord(value), nil
+	}
+	churn, err := getPurgedChurn(stub, msisdn)
+	return churn != nil, err
+}
+
+//=====================================================================================
+//reallocateNumber archives the preference of the previous subscriber of a churned
+//MSISDN and resets its record for the new subscriber. Only the operator that churned
+//the MSISDN reallocates it, after the configured quarantine from the churn. A purged
+//MSISDN is reallocated from the churn kept for it, its archive holds the churn alone.
+//Arguments [msisdn]
+//=====================================================================================
+
+func (dlp *CPM) reallocateNumber(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		logger.Errorf("reallocateNumber : Incorrect number of arguments, Expected 1 [msisdn]")
+		return shim.Error("reallocateNumber : Incorrect number of arguments, Expected 1 [msisdn]")
+	}
+	msisdn := args[0]
+	organization, err := getOrganization(stub)
+	if err != nil {
+		logger.Errorf("reallocateNumber : Getting certificate Details Error : " + string(err.Error()))
+		return shim.Error("reallocateNumber : Getting certificate Details Error : " + string(err.Error()))
+	}
+	config, err := getConfig(stub)
+	if err != nil {
+		logger.Errorf("reallocateNumber : GetState Failed for Config Error : " + string(err.Error()))
+		return shim.Error("reallocateNumber : GetState Failed for Config Error : " + string(err.Error()))
+	}
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		logger.Errorf("reallocateNumber : Getting Transaction Timestamp Error : " + string(err.Error()))
+		return shim.Error("reallocateNumber : Getting Transaction Timestamp Error : " + string(err.Error()))
+	}
+	value, err := stub.GetState(msisdn)
+	if err != nil {
+		logger.Errorf("reallocateNumber : GetState Failed for MSISDN : " + msisdn + " , Error : " + string(err.Error()))
+		return shim.Error("reallocateNumber : GetState Failed for MSISDN : " + msisdn + " , Error : " + string(err.Error()))
+	}
+	var tombstone *Preference
+	switch {
+	case isChurnedRecord(value):
+		tombstone = &Preference{}
+		if err := json.Unmarshal(value, tombstone); err != nil {
+			logger.Errorf("reallocateNumber : Unmarshaling Error : " + string(err.Error()))
+			return shim.Error("reallocateNumber : Unmarshaling Error : " + string(err.Error()))
+		}
+	case value == nil:
+		churn, err := getPurgedChurn(stub, msisdn)
+		if err != nil {
+			logger.Errorf("reallocateNumber : GetState Failed for Churn Error : " + string(err.Error()))
+			return shim.Error("reallocateNumber : GetState Failed for Churn Error : " + string(err.Error()))
+		}
+		if churn != nil {
+			tombstone = &Preference{ObjType: "Preferences", Phone: msisdn, UpdatedBy: churn.ChurnedBy, Status: PREFCHURNED, Churn: churn}
+		}
+	}
+	if tombstone == nil {
+		return shim.Error("{\"Error\":\"MSISDN is not churned, only a churned MSISDN is reallocated \",\"Code\":\"" + ERRNOTCHURNED + "\"}")
+	}
+	if strings.Compare(tombstone.Churn.ChurnedBy, organization) != 0 {
+		logger.Errorf("Unauthorized Access")
+		return shim.Error("Unauthorized Access")
+	}
+	churnTs, err := parseTime(tombstone.Churn.ChurnTs)
+	if err == nil && txTime < churnTs+config.Quarantine {
+		return shim.Error("{\"Error\":\"MSISDN is in quarantine until " + formatTime(churnTs+config.Quarantine) + " \",\"Code\":\"" + ERRQUARANTINE + "\"}")
+	}
+	generation, err := getGeneration(stub, msisdn)
+	if err != nil {
+		logger.Errorf("reallocateNumber : GetState Failed for Generation Error : " + string(err.Error()))
+		return shim.Error("reallocateNumber : GetState Failed for Generation Error : " + string(err.Error()))
+	}
+	archive := ArchivedPreference{ObjType: "PreferenceArchive", Phone: msisdn, Generation: generation, ReallocatedBy: organization, ReallocatedTs: formatTime(txTime), Preference: tombstone}
+	ArchiveAsBytes, err := json.Marshal(archive)
+	if err != nil {
+		logger.Errorf("reallocateNumber : Marshalling Error : " + string(err.Error()))
+		return shim.Error("reallocateNumber : Marshalling Error : " + string(err.Error()))
+	}
+	archiveKey, err := stub.CreateCompositeKey(KEYPREFARCHIVE, []string{msisdn, generationKey(generation)})
+	if err != nil {
+		logger.Errorf("reallocateNumber : Composite Key Creation Error : " + string(err.Error()))
+		return shim.Error("reallocateNumber : Composite Key Creation Error : " + string(err.Error()))
+	}
+	if err := stub.PutState(archiveKey, ArchiveAsBytes); err != nil {
+		logger.Errorf("reallocateNumber : PutState Failed for Archive Error : " + string(err.Error()))
+		return shim.Error("reallocateNumber : PutState Failed for Archive Error : " + string(err.Error()))
+	}
+	counterKey, err := stub.CreateCompositeKey(KEYPREFGENERATION, []string{msisdn})
+	if err != nil {
+		logger.Errorf("reallocateNumber : Composite Key Creation Error : " + string(err.Error()))
+		return shim.Error("reallocateNumber : Composite Key Creation Error : " + string(err.Error()))
+	}
+	if err := stub.PutState(counterKey, []byte(strconv.Itoa(generation+1))); err != nil {
+		logger.Errorf("reallocateNumber : PutState Failed for Generation Error : " + string(err.Error()))
+		return shim.Error("reallocateNumber : PutState Failed for Generation Error : " + string(err.Error()))
+	}
+	//The record and the churn kept after a purge are reset, the new subscriber registers the preferences with sp
+	if err := stub.DelState(msisdn); err != nil {
+		logger.Errorf("reallocateNumber : Removing Preferences from DLT error for MSISDN " + msisdn + " , Error : " + string(err.Error()))
+		return shim.Error("reallocateNumber : Removing Preferences from DLT error for MSISDN " + msisdn + " , Error : " + string(err.Error()))
+	}
+	churnKey, err := stub.CreateCompositeKey(KEYPREFCHURN, []string{msisdn})
+	if err != nil {
+		logger.Errorf("reallocateNumber : Composite Key Creation Error : " + string(err.Error()))
+		return shim.Error("reallocateNumber : Composite Key Creation Error : " + string(err.Error()))
+	}
+	if err := stub.DelState(churnKey); err != nil {
+		logger.Errorf("reallocateNumber : Removing Churn from DLT error for MSISDN " + msisdn + " , Error : " + string(err.Error()))
+		return shim.Error("reallocateNumber : Removing Churn from DLT error for MSISDN " + msisdn + " , Error : " + string(err.Error()))
+	}
+	err = publishEvent(stub, EVTREALLOCATED, ArchiveAsBytes)
+	if err != nil {
+		logger.Errorf("reallocateNumber : Event Creation Error for EventID : " + string(EVTREALLOCATED))
+		return shim.Error("reallocateNumber : Event Creation Error for EventID : " + string(EVTREALLOCATED))
+	}
+	logger.Infof("reallocateNumber : MSISDN " + msisdn + " reallocated, generation " + strconv.Itoa(generation+1))
+	return shim.Success(ArchiveAsBytes)
+}
+
+//=====================================================================================
+//queryArchivedPreferences for the preferences of the previous subscribers of an MSISDN
+//in generation order. Arguments [msisdn], [msisdn, bookmark] or [msisdn, bookmark,
+//format], the format defaults to a JSON array refused over the configured maxqb, the
+//bookmark continues a json, ndjson or csv response truncated at maxqb
+//=====================================================================================
+
+func (dlp *CPM) queryArchivedPreferences(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 1 || len(args) > 3 {
+		return shim.Error("queryArchivedPreferences : Incorrect number of arguments, Expected 1 [msisdn], 2 [msisdn, bookmark] or 3 [msisdn, bookmark, format]")
+	}
+	bookmark, format := "", ""
+	if len(args) > 1 {
+		bookmark = args[1]
+	}
+	if len(args) > 2 {
+		format = args[2]
+	}
+	if format == "" {
+		format = FORMATARRAY
+	}
+	config, err := getConfig(stub)
+	if err != nil {
+		logger.Errorf("queryArchivedPreferences : GetState Failed for Config Error : " + string(err.Error()))
+		return shim.Error("queryArchivedPreferences : GetState Failed for Config Error : " + string(err.Error()))
+	}
+	encoder, _, err := newResultEncoder(format, archiveColumns, config.MaxQueryBytes, bookmark)
+	if err != nil {
+		return shim.Error("{\"Error\":\"" + err.Error() + " \"}")
+	}
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(KEYPREFARCHIVE, []string{args[0]})
+	if err != nil {
+		logger.Errorf("queryArchivedPreferences : GetStateByPartialCompositeKey Failed Error : " + string(err.Error()))
+		return shim.Error("queryArchivedPreferences : GetStateByPartialCompositeKey Failed Error : " + string(err.Error()))
+	}
+	defer resultsIterator.Close()
+	err = encodeResults(resultsIterator, encoder, func(_ string, value []byte) (string, interface{}, error) {
+		return args[0], rawRecord(value), nil
+	})
+	if err != nil {
+		logger.Errorf("queryArchivedPreferences : Iterator Error : " + string(err.Error()))
+		return shim.Error("queryArchivedPreferences : Iterator Error : " + string(err.Error()))
+	}
+	ArchivesAsBytes, err := encoder.finish("")
+	if err != nil {
+		logger.Errorf("queryArchivedPreferences : Marshalling Error : " + string(err.Error()))
+		return shim.Error("queryArchivedPreferences : Marshalling Error : " + string(err.Error()))
+	}
+	return shim.Success(ArchivesAsBytes)
+}
@@ -0,0 +1,250 @@
+/*
+Copyright Tanla Solutions Ltd. 2019 All Rights Reserved.
+Shared tally of valid complaints per sender and the automatic
+graylisting and blacklisting of senders crossing the thresholds.
+Every valid complaint is a delta key of its sender and date, the
+rule windows are counted over the partial keys of their days.
+*/
+
+package main
+
+import (
+	"encoding/json" //reading and writing JSON
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim" // import for Chaincode Interface
+	pb "github.com/hyperledger/fabric/protos/peer"      // import for peer response
+)
+
+//Event Names
+const EVTSENDERSTATUS = "SENDER-STATUS"
+
+//Composite Key Object Types
+const KEYSENDER = "SENDER"
+const KEYSENDERCOMPLAINT = "SENDERCMP"
+
+//Sender Status values, in increasing severity
+const SENDERCLEAR = "clear"
+const SENDERWARNED = "warned"
+const SENDERCAPPED = "capped"
+const SENDERBLACKLISTED = "blacklisted"
+
+//SenderRule Structure, Count valid complaints within Days move the sender to Status
+type SenderRule struct {
+	Status string `json:"status"`
+	Count  int    `json:"count"`
+	Days   int64  `json:"days"`
+}
+
+//SenderComplaint Structure for a valid complaint counted against the sender, kept under its own delta key
+type SenderComplaint struct {
+	ComplaintID  string `json:"cid"`
+	RegisteredTs string `json:"rts"`
+}
+
+//=========================================================================================================
+// Sender structure, holds the current status and Count the valid complaints within the largest rule
+// window at its UpdateTs. The complaints themselves are delta keys, so the record is only written when
+// the status changes
+//=========================================================================================================
+type Sender struct {
+	ObjType  string `json:"obj"`
+	Sender   string `json:"sender"`
+	Count    int    `json:"count"`
+	Status   string `json:"status"`
+	StatusTs string `json:"sts"`
+	UpdateTs string `json:"uts"`
+}
+
+//SenderStatusChange Structure for the sender status event payload
+type SenderStatusChange struct {
+	Sender    *Sender    `json:"sender"`
+	Complaint *Complaint `json:"complaint"`
+}
+
+//senderSeverity orders the sender status values, 0 is returned for an unknown status
+func senderSeverity(status string) int {
+	switch status {
+	case SENDERCLEAR:
+		return 1
+	case SENDERWARNED:
+		return 2
+	case SENDERCAPPED:
+		return 3
+	case SENDERBLACKLISTED:
+		return 4
+	}
+	return 0
+}
+
+//getSender reads the sender status, a clear sender is returned when its status never changed
+func getSender(stub shim.ChaincodeStubInterface, sender string) (*Sender, error) {
+	key, err := stub.CreateCompositeKey(KEYSENDER, []string{sender})
+	if err != nil {
+		return nil, err
+	}
+	value, err := stub.GetState(key)
+	if err != nil {
+		return nil, err
+	}
+	record := &Sender{ObjType: "Sender", Sender: sender, Status: SENDERCLEAR}
+	if value == nil {
+		return record, nil
+	}
+	if err := json.Unmarshal(value, record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+//senderComplaintTimes returns the registration times of the valid complaints of the sender within the
+//largest rule window, read by the partial keys of the days of the window
+func senderComplaintTimes(stub shim.ChaincodeStubInterface, config *Config, sender string, txTime int64) ([]int64, error) {
+	var maxDays int64
+	for _, rule := range config.SenderRules {
+		if rule.Days > maxDays {
+			maxDays = rule.Days
+		}
+	}
+	times := []int64{}
+	from := txTime - maxDays*86400
+	first := time.Unix(from, 0).UTC().Truncate(24 * time.Hour)
+	for day := first; !day.After(time.Unix(txTime, 0).UTC()); day = day.AddDate(0, 0, 1) {
+		resultsIterator, err := stub.GetStateByPartialCompositeKey(KEYSENDERCOMPLAINT, []string{sender, day.Format("2006-01-02")})
+		if err != nil {
+			return nil, err
+		}
+		for resultsIterator.HasNext() {
+			queryResponse, err := resultsIterator.Next()
+			if err != nil {
+				resultsIterator.Close()
+				return nil, err
+			}
+			counted := SenderComplaint{}
+			if err := json.Unmarshal(queryResponse.Value, &counted); err != nil {
+				resultsIterator.Close()
+				return nil, err
+			}
+			registeredTs, err := parseTime(counted.RegisteredTs)
+			if err == nil && registeredTs >= from && registeredTs <= txTime {
+				times = append(times, registeredTs)
+			}
+		}
+		resultsIterator.Close()
+	}
+	return times, nil
+}
+
+//senderStatusOf escalates the status by the rules crossed by the complaint times, it is never lowered
+func senderStatusOf(config *Config, status string, times []int64, txTime int64) string {
+	for _, rule := range config.SenderRules {
+		count := 0
+		for _, registeredTs := range times {
+			if registeredTs >= txTime-rule.Days*86400 {
+				count = count + 1
+			}
+		}
+		if count >= rule.Count && senderSeverity(rule.Status) > senderSeverity(status) {
+			status = rule.Status
+		}
+	}
+	return status
+}
+
+//countSenderComplaint writes the valid complaint under a delta key of the sender, date and complaint
+//and escalates the status by the complaints within the rule windows. The status is never lowered
+//automatically and the sender record is written only when it changes, which the returned flag reports
+func countSenderComplaint(stub shim.ChaincodeStubInterface, config *Config, complaint *Complaint, txTime int64) (*Sender, bool, error) {
+	counted := SenderComplaint{ComplaintID: complaint.ComplaintID, RegisteredTs: formatTime(txTime)}
+	CountedAsBytes, err := json.Marshal(counted)
+	if err != nil {
+		return nil, false, err
+	}
+	date := time.Unix(txTime, 0).UTC().Format("2006-01-02")
+	deltaKey, err := stub.CreateCompositeKey(KEYSENDERCOMPLAINT, []string{complaint.Sender, date, complaint.ComplaintID})
+	if err != nil {
+		return nil, false, err
+	}
+	if err := stub.PutState(deltaKey, CountedAsBytes); err != nil {
+		return nil, false, err
+	}
+	record, err := getSender(stub, complaint.Sender)
+	if err != nil {
+		return nil, false, err
+	}
+	//The delta key written above is not read back within the transaction, so the complaint is counted here
+	times, err := senderComplaintTimes(stub, config, complaint.Sender, txTime)
+	if err != nil {
+		return nil, false, err
+	}
+	times = append(times, txTime)
+	status := senderStatusOf(config, record.Status, times, txTime)
+	if status == record.Status {
+		return record, false, nil
+	}
+	record.Count = len(times)
+	record.Status = status
+	record.StatusTs = formatTime(txTime)
+	record.UpdateTs = formatTime(txTime)
+	key, err := stub.CreateCompositeKey(KEYSENDER, []string{record.Sender})
+	if err != nil {
+		return nil, false, err
+	}
+	SenderAsBytes, err := json.Marshal(record)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := stub.PutState(key, SenderAsBytes); err != nil {
+		return nil, false, err
+	}
+	return record, true, nil
+}
+
+//=====================================================================================
+//querySenderStatus for checking the status of senders before delivering traffic.
+//Arguments [sender, sender, ...], up to the configured maxbatch senders. The count of
+//valid complaints within the largest rule window is read at the time of the query.
+//The response is bounded by the arguments and is not paged
+//=====================================================================================
+
+func (dlp *CPM) querySenderStatus(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) == 0 {
+		return shim.Error("querySenderStatus : Incorrect number of arguments, Expected atleast 1 [sender]")
+	}
+	config, err := getConfig(stub)
+	if err != nil {
+		logger.Errorf("querySenderStatus : GetState Failed for Config Error : " + string(err.Error()))
+		return shim.Error("querySenderStatus : GetState Failed for Config Error : " + string(err.Error()))
+	}
+	if len(args) > config.MaxBatchSize {
+		logger.Errorf("querySenderStatus : " + batchTooLargeResp(len(args), config))
+		return shim.Error(batchTooLargeResp(len(args), config))
+	}
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		logger.Errorf("querySenderStatus : Getting Transaction Timestamp Error : " + string(err.Error()))
+		return shim.Error("querySenderStatus : Getting Transaction Timestamp Error : " + string(err.Error()))
+	}
+	senders := []*Sender{}
+	for _, sender := range args {
+		record, err := getSender(stub, sender)
+		if err != nil {
+			logger.Errorf("querySenderStatus : GetState Failed for Sender : " + sender + " , Error : " + string(err.Error()))
+			return shim.Error("querySenderStatus : GetState Failed for Sender : " + sender + " , Error : " + string(err.Error()))
+		}
+		times, err := senderComplaintTimes(stub, config, sender, txTime)
+		if err != nil {
+			logger.Errorf("querySenderStatus : GetStateByPartialCompositeKey Failed for Sender : " + sender + " , Error : " + string(err.Error()))
+			return shim.Error("querySenderStatus : GetStateByPartialCompositeKey Failed for Sender : " + sender + " , Error : " + string(err.Error()))
+		}
+		record.Count = len(times)
+		record.UpdateTs = formatTime(txTime)
+		senders = append(senders, record)
+	}
+	SendersAsBytes, err := json.Marshal(senders)
+	if err != nil {
+		logger.Errorf("querySenderStatus : Marshalling Error : " + string(err.Error()))
+		return shim.Error("querySenderStatus : Marshalling Error : " + string(err.Error()))
+	}
+	return shim.Success(SendersAsBytes)
+}
@@ -0,0 +1,406 @@
+/*
+Copyright Tanla Solutions Ltd. 2019 All Rights Reserved.
+Aggregate statistics of the preferences per operator, blocking,
+category and communication mode. Every write of a preference
+stores its own delta keys, so parallel writes never update a
+shared counter. The regulator rolls the deltas of past days up
+into totals, and the query folds the deltas left into them.
+*/
+
+package main
+
+import (
+	"encoding/json" //reading and writing JSON
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim" // import for Chaincode Interface
+	pb "github.com/hyperledger/fabric/protos/peer"      // import for peer response
+)
+
+//Composite Key Object Types, the attributes are operator, date, dimension, value, txid and MSISDN for
+//the deltas, operator, dimension and value for the rolled up totals and the MSISDN for the marker of an
+//MSISDN whose record is counted
+const KEYSTATDELTA = "STATDELTA"
+const KEYSTATTOTAL = "STATTOTAL"
+const KEYSTATCOUNTED = "STATCOUNTED"
+
+//Statistics Dimensions
+const DIMBLOCK = "block"
+const DIMCATEGORY = "category"
+const DIMCMODE = "cmode"
+
+//Blocking values, a preference with category 0 is fully blocked
+const BLOCKFULL = "full"
+const BLOCKPARTIAL = "partial"
+
+//StatTotal Structure for the folded count of a dimension value of an operator. RolledUp is the part of
+//the count rolled up, ByDate holds the net change of the count per date of the deltas not rolled up
+type StatTotal struct {
+	Operator  string         `json:"operator"`
+	Dimension string         `json:"dimension"`
+	Value     string         `json:"value"`
+	Total     int            `json:"total"`
+	RolledUp  int            `json:"rolled"`
+	ByDate    map[string]int `json:"dates"`
+}
+
+//StatRollup Structure for the response of a roll up call, Complete is false when deltas of the date are left
+type StatRollup struct {
+	Operator string `json:"operator"`
+	Date     string `json:"date"`
+	Folded   int    `json:"folded"`
+	Complete bool   `json:"complete"`
+}
+
+//statValues returns the counted dimension values of the stored preference. The latest registered
+//preference is counted, the pending one when present. A tombstone is not counted
+func statValues(preference *Preference) map[[3]string]bool {
+	values := make(map[[3]string]bool)
+	if preference == nil || preference.Status == PREFCHURNED {
+		return values
+	}
+	counted := preference
+	if preference.Pending != nil {
+		counted = preference.Pending
+	}
+	block := BLOCKPARTIAL
+	if containsCode(counted.Category, "0") {
+		block = BLOCKFULL
+	}
+	values[[3]string{preference.UpdatedBy, DIMBLOCK, block}] = true
+	for _, code := range strings.Split(counted.Category, ",") {
+		if code = strings.TrimSpace(code); code != "" {
+			values[[3]string{preference.UpdatedBy, DIMCATEGORY, code}] = true
+		}
+	}
+	for _, code := range strings.Split(counted.CommunicationMode, ",") {
+		if code = strings.TrimSpace(code); code != "" {
+			values[[3]string{preference.UpdatedBy, DIMCMODE, code}] = true
+		}
+	}
+	return values
+}
+
+//isStatCounted checks whether the record of the MSISDN is counted in the statistics. Records stored
+//before the statistics are not counted until they are written again or backfilled by rebuildIndexes
+func isStatCounted(stub shim.ChaincodeStubInterface, msisdn string) (bool, error) {
+	key, err := stub.CreateCompositeKey(KEYSTATCOUNTED, []string{msisdn})
+	if err != nil {
+		return false, err
+	}
+	value, err := stub.GetState(key)
+	return value != nil, err
+}
+
+//updatePreferenceStats stores the delta keys of the change from the previous to the current record
+//of an MSISDN, nil is passed for a record that does not exist. A previous record that is not counted
+//is taken as not existing, so its values are not taken off the counts
+func updatePreferenceStats(stub shim.ChaincodeStubInterface, previous *Preference, current *Preference, txTime int64) error {
+	date := time.Unix(txTime, 0).UTC().Format("2006-01-02")
+	phone := ""
+	for _, record := range []*Preference{previous, current} {
+		if record != nil {
+			phone = record.Phone
+		}
+	}
+	counted, err := isStatCounted(stub, phone)
+	if err != nil {
+		return err
+	}
+	if !counted {
+		previous = nil
+		key, err := stub.CreateCompositeKey(KEYSTATCOUNTED, []string{phone})
+		if err != nil {
+			return err
+		}
+		if err := stub.PutState(key, indexEntryValue); err != nil {
+			return err
+		}
+	}
+	previousValues := statValues(previous)
+	currentValues := statValues(current)
+	deltas := make(map[[3]string]string)
+	for value := range previousValues {
+		if !currentValues[value] {
+			deltas[value] = "-1"
+		}
+	}
+	for value := range currentValues {
+		if !previousValues[value] {
+			deltas[value] = "1"
+		}
+	}
+	for value, delta := range deltas {
+		key, err := stub.CreateCompositeKey(KEYSTATDELTA, []string{value[0], date, value[1], value[2], stub.GetTxID(), phone})
+		if err != nil {
+			return err
+		}
+		if err := stub.PutState(key, []byte(delta)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//trackPreferenceWrite maintains the indexes and the statistics of a written preference
+func trackPreferenceWrite(stub shim.ChaincodeStubInterface, previous *Preference, current *Preference) error {
+	if err := updatePreferenceIndexes(stub, previous, current); err != nil {
+		return err
+	}
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		return err
+	}
+	return updatePreferenceStats(stub, previous, current, txTime)
+}
+
+//=====================================================================================
+//queryStatistics folds the delta keys left into the rolled up totals per operator, dimension
+//and value. Arguments [], [operator], [operator, bookmark] or [operator, bookmark, format], an
+//operator sees its own counts and the regulator any, an empty operator stands for all operators
+//the caller sees. The format defaults to a JSON array refused over the configured maxqb,
+//the bookmark continues a json, ndjson or csv response truncated at maxqb
+//=====================================================================================
+
+func (dlp *CPM) queryStatistics(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) > 3 {
+		return shim.Error("queryStatistics : Incorrect number of arguments, Expected 0, 1 [operator], 2 [operator, bookmark] or 3 [operator, bookmark, format]")
+	}
+	operator, bookmark, format := "", "", ""
+	if len(args) > 0 {
+		operator = args[0]
+	}
+	if len(args) > 1 {
+		bookmark = args[1]
+	}
+	if len(args) > 2 {
+		format = args[2]
+	}
+	if format == "" {
+		format = FORMATARRAY
+	}
+	organization, err := getOrganization(stub)
+	if err != nil {
+		logger.Errorf("queryStatistics : Getting certificate Details Error : " + string(err.Error()))
+		return shim.Error("queryStatistics : Getting certificate Details Error : " + string(err.Error()))
+	}
+	config, err := getConfig(stub)
+	if err != nil {
+		logger.Errorf("queryStatistics : GetState Failed for Config Error : " + string(err.Error()))
+		return shim.Error("queryStatistics : GetState Failed for Config Error : " + string(err.Error()))
+	}
+	var attributes []string
+	if operator != "" {
+		attributes = []string{operator}
+	}
+	if !isRegulator(config, organization) {
+		if operator != "" && strings.Compare(operator, organization) != 0 {
+			logger.Errorf("Unauthorized Access")
+			return shim.Error("Unauthorized Access")
+		}
+		attributes = []string{organization}
+	}
+	encoder, _, err := newResultEncoder(format, statColumns, config.MaxQueryBytes, bookmark)
+	if err != nil {
+		return shim.Error("{\"Error\":\"" + err.Error() + " \"}")
+	}
+	totals := make(map[[3]string]*StatTotal)
+	totalOf := func(value [3]string) *StatTotal {
+		total, ok := totals[value]
+		if !ok {
+			total = &StatTotal{Operator: value[0], Dimension: value[1], Value: value[2], ByDate: map[string]int{}}
+			totals[value] = total
+		}
+		return total
+	}
+	rollupIterator, err := stub.GetStateByPartialCompositeKey(KEYSTATTOTAL, attributes)
+	if err != nil {
+		logger.Errorf("queryStatistics : GetStateByPartialCompositeKey Failed Error : " + string(err.Error()))
+		return shim.Error("queryStatistics : GetStateByPartialCompositeKey Failed Error : " + string(err.Error()))
+	}
+	defer rollupIterator.Close()
+	for rollupIterator.HasNext() {
+		queryResponse, err := rollupIterator.Next()
+		if err != nil {
+			logger.Errorf("queryStatistics : Iterator Error : " + string(err.Error()))
+			return shim.Error("queryStatistics : Iterator Error : " + string(err.Error()))
+		}
+		_, keyParts, err := stub.SplitCompositeKey(queryResponse.Key)
+		if err != nil || len(keyParts) != 3 {
+			continue
+		}
+		rolled, err := strconv.Atoi(string(queryResponse.Value))
+		if err != nil {
+			continue
+		}
+		total := totalOf([3]string{keyParts[0], keyParts[1], keyParts[2]})
+		total.Total = total.Total + rolled
+		total.RolledUp = rolled
+	}
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(KEYSTATDELTA, attributes)
+	if err != nil {
+		logger.Errorf("queryStatistics : GetStateByPartialCompositeKey Failed Error : " + string(err.Error()))
+		return shim.Error("queryStatistics : GetStateByPartialCompositeKey Failed Error : " + string(err.Error()))
+	}
+	defer resultsIterator.Close()
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			logger.Errorf("queryStatistics : Iterator Error : " + string(err.Error()))
+			return shim.Error("queryStatistics : Iterator Error : " + string(err.Error()))
+		}
+		_, keyParts, err := stub.SplitCompositeKey(queryResponse.Key)
+		if err != nil || len(keyParts) != 6 {
+			continue
+		}
+		delta, err := strconv.Atoi(string(queryResponse.Value))
+		if err != nil {
+			continue
+		}
+		total := totalOf([3]string{keyParts[0], keyParts[2], keyParts[3]})
+		total.Total = total.Total + delta
+		total.ByDate[keyParts[1]] = total.ByDate[keyParts[1]] + delta
+	}
+	stats := []*StatTotal{}
+	for _, total := range totals {
+		stats = append(stats, total)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Operator != stats[j].Operator {
+			return stats[i].Operator < stats[j].Operator
+		}
+		if stats[i].Dimension != stats[j].Dimension {
+			return stats[i].Dimension < stats[j].Dimension
+		}
+		return stats[i].Value < stats[j].Value
+	})
+	//The totals are written in their sorted order, the positions of a continuation run over them
+	for _, total := range stats {
+		if !encoder.next() {
+			continue
+		}
+		written, err := encoder.encode(total.Operator, total)
+		if err != nil {
+			logger.Errorf("queryStatistics : Marshalling Error : " + string(err.Error()))
+			return shim.Error("queryStatistics : Marshalling Error : " + string(err.Error()))
+		}
+		if !written {
+			break
+		}
+	}
+	StatsAsBytes, err := encoder.finish("")
+	if err != nil {
+		logger.Errorf("queryStatistics : Marshalling Error : " + string(err.Error()))
+		return shim.Error("queryStatistics : Marshalling Error : " + string(err.Error()))
+	}
+	return shim.Success(StatsAsBytes)
+}
+
+//=====================================================================================
+//rollupStatistics folds the delta keys of an operator on a past date into the rolled
+//up totals and deletes them, so the statistics query reads a total per dimension value
+//in place of every delta. Arguments [operator, date], the date is YYYY-MM-DD before the
+//transaction date, so no write adds deltas to it while it is rolled up. Up to the
+//configured maxbatch deltas are folded per call, Complete is set once the date is done
+//=====================================================================================
+
+func (dlp *CPM) rollupStatistics(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 {
+		return shim.Error("rollupStatistics : Incorrect number of arguments, Expected 2 [operator, date]")
+	}
+	operator, date := args[0], args[1]
+	day, err := time.Parse("2006-01-02", date)
+	if err != nil {
+		return shim.Error("{\"Error\":\"date shall be a YYYY-MM-DD date \"}")
+	}
+	config, err := getConfig(stub)
+	if err != nil {
+		logger.Errorf("rollupStatistics : GetState Failed for Config Error : " + string(err.Error()))
+		return shim.Error("rollupStatistics : GetState Failed for Config Error : " + string(err.Error()))
+	}
+	organization, err := getOrganization(stub)
+	if err != nil {
+		logger.Errorf("rollupStatistics : Getting certificate Details Error : " + string(err.Error()))
+		return shim.Error("rollupStatistics : Getting certificate Details Error : " + string(err.Error()))
+	}
+	if !isRegulator(config, organization) {
+		logger.Errorf("Unauthorized Access")
+		return shim.Error("Unauthorized Access")
+	}
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		logger.Errorf("rollupStatistics : Getting Transaction Timestamp Error : " + string(err.Error()))
+		return shim.Error("rollupStatistics : Getting Transaction Timestamp Error : " + string(err.Error()))
+	}
+	if !day.Before(time.Unix(txTime, 0).UTC().Truncate(24 * time.Hour)) {
+		return shim.Error("{\"Error\":\"date shall be before the transaction date \"}")
+	}
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(KEYSTATDELTA, []string{operator, date})
+	if err != nil {
+		logger.Errorf("rollupStatistics : GetStateByPartialCompositeKey Failed Error : " + string(err.Error()))
+		return shim.Error("rollupStatistics : GetStateByPartialCompositeKey Failed Error : " + string(err.Error()))
+	}
+	defer resultsIterator.Close()
+	rollup := StatRollup{Operator: operator, Date: date, Complete: true}
+	folded := make(map[[3]string]int)
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			logger.Errorf("rollupStatistics : Iterator Error : " + string(err.Error()))
+			return shim.Error("rollupStatistics : Iterator Error : " + string(err.Error()))
+		}
+		if rollup.Folded == config.MaxBatchSize {
+			rollup.Complete = false
+			break
+		}
+		_, keyParts, err := stub.SplitCompositeKey(queryResponse.Key)
+		if err != nil || len(keyParts) != 6 {
+			continue
+		}
+		delta, err := strconv.Atoi(string(queryResponse.Value))
+		if err != nil {
+			continue
+		}
+		value := [3]string{keyParts[0], keyParts[2], keyParts[3]}
+		folded[value] = folded[value] + delta
+		if err := stub.DelState(queryResponse.Key); err != nil {
+			logger.Errorf("rollupStatistics : DelState Failed for Delta Error : " + string(err.Error()))
+			return shim.Error("rollupStatistics : DelState Failed for Delta Error : " + string(err.Error()))
+		}
+		rollup.Folded = rollup.Folded + 1
+	}
+	for value, delta := range folded {
+		key, err := stub.CreateCompositeKey(KEYSTATTOTAL, value[:])
+		if err != nil {
+			logger.Errorf("rollupStatistics : Composite Key Creation Error : " + string(err.Error()))
+			return shim.Error("rollupStatistics : Composite Key Creation Error : " + string(err.Error()))
+		}
+		total := 0
+		stored, err := stub.GetState(key)
+		if err != nil {
+			logger.Errorf("rollupStatistics : GetState Failed for Total Error : " + string(err.Error()))
+			return shim.Error("rollupStatistics : GetState Failed for Total Error : " + string(err.Error()))
+		}
+		if stored != nil {
+			total, err = strconv.Atoi(string(stored))
+			if err != nil {
+				logger.Errorf("rollupStatistics : Total is not numeric Error : " + string(err.Error()))
+				return shim.Error("rollupStatistics : Total is not numeric Error : " + string(err.Error()))
+			}
+		}
+		if err := stub.PutState(key, []byte(strconv.Itoa(total+delta))); err != nil {
+			logger.Errorf("rollupStatistics : PutState Failed for Total Error : " + string(err.Error()))
+			return shim.Error("rollupStatistics : PutState Failed for Total Error : " + string(err.Error()))
+		}
+	}
+	logger.Infof("rollupStatistics : Folded " + strconv.Itoa(rollup.Folded) + " deltas of " + operator + " on " + date)
+	RollupAsBytes, err := json.Marshal(rollup)
+	if err != nil {
+		logger.Errorf("rollupStatistics : Marshalling Error : " + string(err.Error()))
+		return shim.Error("rollupStatistics : Marshalling Error : " + string(err.Error()))
+	}
+	return shim.Success(RollupAsBytes)
+}
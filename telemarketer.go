@@ -0,0 +1,453 @@
+/*
+Copyright Tanla Solutions Ltd. 2019 All Rights Reserved.
+Telemarketer registry and the binding of a principal entity
+to the ordered chain of telemarketers that delivers its traffic.
+An entity is registered to the organization binding it first,
+only that organization and the regulator bind its chains.
+*/
+
+package main
+
+import (
+	"encoding/json" //reading and writing JSON
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim" // import for Chaincode Interface
+	pb "github.com/hyperledger/fabric/protos/peer"      // import for peer response
+)
+
+//Event Names
+const EVTREGTELEMARKETER = "REGISTER-TELEMARKETER"
+const EVTBINDTELEMARKETER = "BIND-TELEMARKETER"
+
+//Composite Key Object Types
+const KEYTELEMARKETER = "TELEMARKETER"
+const KEYTMBINDING = "TMBINDING"
+const KEYTMENTITY = "TMENTITY"
+
+//Telemarketer Types, a chain is aggregators followed by one delivery telemarketer
+const TMAGGREGATOR = "aggregator"
+const TMDELIVERY = "delivery"
+
+//Telemarketer Status values
+const TMACTIVE = "active"
+const TMSUSPENDED = "suspended"
+
+//=========================================================================================================
+// Telemarketer structure, registered by an operator. Type is aggregator or delivery
+//=========================================================================================================
+type Telemarketer struct {
+	ObjType      string `json:"obj"`
+	TmID         string `json:"tmid"`
+	Name         string `json:"name"`
+	TmType       string `json:"type"`
+	Status       string `json:"status"`
+	RegisteredBy string `json:"rby"`
+	CreateTs     string `json:"cts"`
+	UpdateTs     string `json:"uts"`
+}
+
+//=========================================================================================================
+// Binding structure, links a principal entity to an ordered chain of telemarketers for a validity period
+//=========================================================================================================
+type Binding struct {
+	ObjType   string   `json:"obj"`
+	EntityID  string   `json:"entity"`
+	Chain     []string `json:"chain"`
+	ValidFrom string   `json:"vfrom"`
+	ValidTo   string   `json:"vto"`
+	BoundBy   string   `json:"bby"`
+	UpdateTs  string   `json:"uts"`
+}
+
+//Verification Structure for the chain verification response
+type Verification struct {
+	EntityID   string   `json:"entity"`
+	Chain      []string `json:"chain"`
+	Authorised bool     `json:"authorised"`
+	Reason     string   `json:"reason"`
+}
+
+//getTelemarketer reads the registered telemarketer, nil is returned when it is not registered
+func getTelemarketer(stub shim.ChaincodeStubInterface, tmID string) (*Telemarketer, error) {
+	key, err := stub.CreateCompositeKey(KEYTELEMARKETER, []string{tmID})
+	if err != nil {
+		return nil, err
+	}
+	value, err := stub.GetState(key)
+	if err != nil || value == nil {
+		return nil, err
+	}
+	telemarketer := &Telemarketer{}
+	if err := json.Unmarshal(value, telemarketer); err != nil {
+		return nil, err
+	}
+	return telemarketer, nil
+}
+
+//getEntityRegistrant reads the organization the entity is registered to, empty when it was never bound
+func getEntityRegistrant(stub shim.ChaincodeStubInterface, entityID string) (string, error) {
+	key, err := stub.CreateCompositeKey(KEYTMENTITY, []string{entityID})
+	if err != nil {
+		return "", err
+	}
+	value, err := stub.GetState(key)
+	return string(value), err
+}
+
+//getTelemarketerAt reads the telemarketer as it was registered at the given time from the history of its
+//key, nil is returned when it was not registered by then
+func getTelemarketerAt(stub shim.ChaincodeStubInterface, tmID string, at int64) (*Telemarketer, error) {
+	key, err := stub.CreateCompositeKey(KEYTELEMARKETER, []string{tmID})
+	if err != nil {
+		return nil, err
+	}
+	historyIterator, err := stub.GetHistoryForKey(key)
+	if err != nil {
+		return nil, err
+	}
+	defer historyIterator.Close()
+
+	var telemarketer *Telemarketer
+	var telemarketerTs int64
+	for historyIterator.HasNext() {
+		modification, err := historyIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		if modification.Timestamp == nil || modification.Timestamp.Seconds > at {
+			continue
+		}
+		if telemarketer != nil && modification.Timestamp.Seconds < telemarketerTs {
+			continue
+		}
+		if modification.IsDelete {
+			continue
+		}
+		registered := &Telemarketer{}
+		if err := json.Unmarshal(modification.Value, registered); err != nil {
+			return nil, err
+		}
+		telemarketer = registered
+		telemarketerTs = modification.Timestamp.Seconds
+	}
+	return telemarketer, nil
+}
+
+//=====================================================================================
+//registerTelemarketer for registering a new telemarketer or updating an existing one
+//=====================================================================================
+
+func (dlp *CPM) registerTelemarketer(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		jsonResp := "{\"tmid\":\"value\",\"name\":\"value\",\"type\":\"aggregator|delivery\",\"status\":\"active|suspended\"}"
+		logger.Errorf("registerTelemarketer : Incorrect Number Of Arguments, Expected json structure : " + jsonResp)
+		return shim.Error("registerTelemarketer : Incorrect Number Of Arguments, Expected json structure : " + jsonResp)
+	}
+	input := Telemarketer{}
+	if err := json.Unmarshal([]byte(args[0]), &input); err != nil {
+		logger.Errorf("registerTelemarketer : Input arguments unmarhsaling Error : " + string(err.Error()))
+		return shim.Error("registerTelemarketer : Input arguments unmarhsaling Error : " + string(err.Error()))
+	}
+	if input.TmID == "" || input.Name == "" {
+		return shim.Error("{\"Error\":\"tmid and name are mandatory \"}")
+	}
+	if input.TmType != TMAGGREGATOR && input.TmType != TMDELIVERY {
+		return shim.Error("{\"Error\":\"type shall be aggregator or delivery \"}")
+	}
+	if input.Status == "" {
+		input.Status = TMACTIVE
+	}
+	if input.Status != TMACTIVE && input.Status != TMSUSPENDED {
+		return shim.Error("{\"Error\":\"status shall be active or suspended \"}")
+	}
+	organization, err := getOrganization(stub)
+	if err != nil {
+		logger.Errorf("registerTelemarketer : Getting certificate Details Error : " + string(err.Error()))
+		return shim.Error("registerTelemarketer : Getting certificate Details Error : " + string(err.Error()))
+	}
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		logger.Errorf("registerTelemarketer : Getting Transaction Timestamp Error : " + string(err.Error()))
+		return shim.Error("registerTelemarketer : Getting Transaction Timestamp Error : " + string(err.Error()))
+	}
+	existing, err := getTelemarketer(stub, input.TmID)
+	if err != nil {
+		logger.Errorf("registerTelemarketer : GetState Failed for Telemarketer : " + input.TmID + " , Error : " + string(err.Error()))
+		return shim.Error("registerTelemarketer : GetState Failed for Telemarketer : " + input.TmID + " , Error : " + string(err.Error()))
+	}
+	TmStruct := &Telemarketer{}
+	TmStruct.ObjType = "Telemarketer"
+	TmStruct.TmID = input.TmID
+	TmStruct.Name = input.Name
+	TmStruct.TmType = input.TmType
+	TmStruct.Status = input.Status
+	TmStruct.RegisteredBy = organization
+	TmStruct.CreateTs = formatTime(txTime)
+	TmStruct.UpdateTs = formatTime(txTime)
+	if existing != nil {
+		if strings.Compare(existing.RegisteredBy, organization) != 0 {
+			logger.Errorf("Unauthorized Access")
+			return shim.Error("Unauthorized Access")
+		}
+		TmStruct.CreateTs = existing.CreateTs
+	}
+	TmAsBytes, err := json.Marshal(TmStruct)
+	if err != nil {
+		logger.Errorf("registerTelemarketer : Marshalling Error : " + string(err.Error()))
+		return shim.Error("registerTelemarketer : Marshalling Error : " + string(err.Error()))
+	}
+	key, err := stub.CreateCompositeKey(KEYTELEMARKETER, []string{TmStruct.TmID})
+	if err != nil {
+		logger.Errorf("registerTelemarketer : Composite Key Creation Error : " + string(err.Error()))
+		return shim.Error("registerTelemarketer : Composite Key Creation Error : " + string(err.Error()))
+	}
+	err = stub.PutState(key, TmAsBytes)
+	if err != nil {
+		logger.Errorf("registerTelemarketer : PutState Failed Error : " + string(err.Error()))
+		return shim.Error("registerTelemarketer : PutState Failed Error : " + string(err.Error()))
+	}
+	err = publishEvent(stub, EVTREGTELEMARKETER, TmAsBytes)
+	if err != nil {
+		logger.Errorf("registerTelemarketer : Event Creation Error for EventID : " + string(EVTREGTELEMARKETER))
+		return shim.Error("registerTelemarketer : Event Creation Error for EventID : " + string(EVTREGTELEMARKETER))
+	}
+	logger.Infof("registerTelemarketer : PutState Success : " + string(TmAsBytes))
+	return shim.Success([]byte("registerTelemarketer : Telemarketer registered Successfully : " + TmStruct.TmID + " , TransactionID : " + stub.GetTxID()))
+}
+
+//=====================================================================================
+//bindTelemarketers for binding a principal entity to an ordered chain of telemarketers,
+//the aggregators in delivery order followed by one delivery telemarketer. The entity is
+//registered to the first organization binding it, other than the regulator, and only
+//that organization and the regulator bind chains for it afterwards
+//=====================================================================================
+
+func (dlp *CPM) bindTelemarketers(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		jsonResp := "{\"entity\":\"value\",\"chain\":[\"tmid\",\"tmid\"],\"vfrom\":\"value\",\"vto\":\"value\"}"
+		logger.Errorf("bindTelemarketers : Incorrect Number Of Arguments, Expected json structure : " + jsonResp)
+		return shim.Error("bindTelemarketers : Incorrect Number Of Arguments, Expected json structure : " + jsonResp)
+	}
+	input := Binding{}
+	if err := json.Unmarshal([]byte(args[0]), &input); err != nil {
+		logger.Errorf("bindTelemarketers : Input arguments unmarhsaling Error : " + string(err.Error()))
+		return shim.Error("bindTelemarketers : Input arguments unmarhsaling Error : " + string(err.Error()))
+	}
+	if input.EntityID == "" || len(input.Chain) == 0 {
+		return shim.Error("{\"Error\":\"entity and chain are mandatory \"}")
+	}
+	validFrom, err := parseTime(input.ValidFrom)
+	if err != nil {
+		return shim.Error("{\"Error\":\"vfrom is not numeric \"}")
+	}
+	validTo, err := parseTime(input.ValidTo)
+	if err != nil {
+		return shim.Error("{\"Error\":\"vto is not numeric \"}")
+	}
+	if validTo <= validFrom {
+		return shim.Error("{\"Error\":\"vto shall be later than vfrom \"}")
+	}
+	for position, tmID := range input.Chain {
+		telemarketer, err := getTelemarketer(stub, tmID)
+		if err != nil {
+			logger.Errorf("bindTelemarketers : GetState Failed for Telemarketer : " + tmID + " , Error : " + string(err.Error()))
+			return shim.Error("bindTelemarketers : GetState Failed for Telemarketer : " + tmID + " , Error : " + string(err.Error()))
+		}
+		if telemarketer == nil {
+			return shim.Error("bindTelemarketers : Telemarketer is not registered : " + tmID)
+		}
+		if telemarketer.Status != TMACTIVE {
+			return shim.Error("bindTelemarketers : Telemarketer is not active : " + tmID)
+		}
+		role := TMAGGREGATOR
+		if position == len(input.Chain)-1 {
+			role = TMDELIVERY
+		}
+		if telemarketer.TmType != role {
+			return shim.Error("{\"Error\":\"chain shall be aggregators followed by one delivery telemarketer, " + tmID + " is " + telemarketer.TmType + " at position " + strconv.Itoa(position) + " \"}")
+		}
+	}
+	organization, err := getOrganization(stub)
+	if err != nil {
+		logger.Errorf("bindTelemarketers : Getting certificate Details Error : " + string(err.Error()))
+		return shim.Error("bindTelemarketers : Getting certificate Details Error : " + string(err.Error()))
+	}
+	config, err := getConfig(stub)
+	if err != nil {
+		logger.Errorf("bindTelemarketers : GetState Failed for Config Error : " + string(err.Error()))
+		return shim.Error("bindTelemarketers : GetState Failed for Config Error : " + string(err.Error()))
+	}
+	regulator := isRegulator(config, organization)
+	registrant, err := getEntityRegistrant(stub, input.EntityID)
+	if err != nil {
+		logger.Errorf("bindTelemarketers : GetState Failed for Entity Registrant : " + input.EntityID + " , Error : " + string(err.Error()))
+		return shim.Error("bindTelemarketers : GetState Failed for Entity Registrant : " + input.EntityID + " , Error : " + string(err.Error()))
+	}
+	if !regulator && registrant != "" && strings.Compare(registrant, organization) != 0 {
+		logger.Errorf("Unauthorized Access")
+		return shim.Error("Unauthorized Access")
+	}
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		logger.Errorf("bindTelemarketers : Getting Transaction Timestamp Error : " + string(err.Error()))
+		return shim.Error("bindTelemarketers : Getting Transaction Timestamp Error : " + string(err.Error()))
+	}
+	key, err := stub.CreateCompositeKey(KEYTMBINDING, append([]string{input.EntityID}, input.Chain...))
+	if err != nil {
+		logger.Errorf("bindTelemarketers : Composite Key Creation Error : " + string(err.Error()))
+		return shim.Error("bindTelemarketers : Composite Key Creation Error : " + string(err.Error()))
+	}
+	value, err := stub.GetState(key)
+	if err != nil {
+		logger.Errorf("bindTelemarketers : GetState Failed for Entity : " + input.EntityID + " , Error : " + string(err.Error()))
+		return shim.Error("bindTelemarketers : GetState Failed for Entity : " + input.EntityID + " , Error : " + string(err.Error()))
+	}
+	if value != nil {
+		existing := Binding{}
+		if err := json.Unmarshal(value, &existing); err != nil {
+			logger.Errorf("bindTelemarketers : Existing binding data Unmarhsaling Error : " + string(err.Error()))
+			return shim.Error("bindTelemarketers : Existing binding data Unmarhsaling Error : " + string(err.Error()))
+		}
+		//A chain bound before the entities were registered stays with the organization that bound it
+		if !regulator && registrant == "" && strings.Compare(existing.BoundBy, organization) != 0 {
+			logger.Errorf("Unauthorized Access")
+			return shim.Error("Unauthorized Access")
+		}
+	}
+	if !regulator && registrant == "" {
+		entityKey, err := stub.CreateCompositeKey(KEYTMENTITY, []string{input.EntityID})
+		if err != nil {
+			logger.Errorf("bindTelemarketers : Composite Key Creation Error : " + string(err.Error()))
+			return shim.Error("bindTelemarketers : Composite Key Creation Error : " + string(err.Error()))
+		}
+		err = stub.PutState(entityKey, []byte(organization))
+		if err != nil {
+			logger.Errorf("bindTelemarketers : PutState Failed for Entity Registrant Error : " + string(err.Error()))
+			return shim.Error("bindTelemarketers : PutState Failed for Entity Registrant Error : " + string(err.Error()))
+		}
+	}
+	BindStruct := &Binding{}
+	BindStruct.ObjType = "TmBinding"
+	BindStruct.EntityID = input.EntityID
+	BindStruct.Chain = input.Chain
+	BindStruct.ValidFrom = input.ValidFrom
+	BindStruct.ValidTo = input.ValidTo
+	BindStruct.BoundBy = organization
+	BindStruct.UpdateTs = formatTime(txTime)
+	BindAsBytes, err := json.Marshal(BindStruct)
+	if err != nil {
+		logger.Errorf("bindTelemarketers : Marshalling Error : " + string(err.Error()))
+		return shim.Error("bindTelemarketers : Marshalling Error : " + string(err.Error()))
+	}
+	err = stub.PutState(key, BindAsBytes)
+	if err != nil {
+		logger.Errorf("bindTelemarketers : PutState Failed Error : " + string(err.Error()))
+		return shim.Error("bindTelemarketers : PutState Failed Error : " + string(err.Error()))
+	}
+	err = publishEvent(stub, EVTBINDTELEMARKETER, BindAsBytes)
+	if err != nil {
+		logger.Errorf("bindTelemarketers : Event Creation Error for EventID : " + string(EVTBINDTELEMARKETER))
+		return shim.Error("bindTelemarketers : Event Creation Error for EventID : " + string(EVTBINDTELEMARKETER))
+	}
+	logger.Infof("bindTelemarketers : PutState Success : " + string(BindAsBytes))
+	return shim.Success([]byte("bindTelemarketers : Telemarketer chain bound Successfully for Entity : " + BindStruct.EntityID + " , TransactionID : " + stub.GetTxID()))
+}
+
+//=====================================================================================
+//verifyTelemarketers checks whether the telemarketer chain seen on a message is
+//authorised for the entity. Arguments [entity, chain as json array, time (optional)]
+//=====================================================================================
+
+func (dlp *CPM) verifyTelemarketers(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 && len(args) != 3 {
+		logger.Errorf("verifyTelemarketers : Incorrect number of arguments, Expected 2 [entity,chain] or 3 [entity,chain,time]")
+		return shim.Error("verifyTelemarketers : Incorrect number of arguments, Expected 2 [entity,chain] or 3 [entity,chain,time]")
+	}
+	var chain []string
+	if err := json.Unmarshal([]byte(args[1]), &chain); err != nil {
+		logger.Errorf("verifyTelemarketers : Chain unmarhsaling Error : " + string(err.Error()))
+		return shim.Error("verifyTelemarketers : Chain unmarhsaling Error : " + string(err.Error()))
+	}
+	var at int64
+	var err error
+	if len(args) == 3 {
+		at, err = parseTime(args[2])
+		if err != nil {
+			return shim.Error("{\"Error\":\"time is not numeric \"}")
+		}
+	} else {
+		at, err = getTxTime(stub)
+		if err != nil {
+			logger.Errorf("verifyTelemarketers : Getting Transaction Timestamp Error : " + string(err.Error()))
+			return shim.Error("verifyTelemarketers : Getting Transaction Timestamp Error : " + string(err.Error()))
+		}
+	}
+	verification, err := verifyChain(stub, args[0], chain, at)
+	if err != nil {
+		logger.Errorf("verifyTelemarketers : Verification Error : " + string(err.Error()))
+		return shim.Error("verifyTelemarketers : Verification Error : " + string(err.Error()))
+	}
+	verificationAsBytes, err := json.Marshal(verification)
+	if err != nil {
+		logger.Errorf("verifyTelemarketers : Marshalling Error : " + string(err.Error()))
+		return shim.Error("verifyTelemarketers : Marshalling Error : " + string(err.Error()))
+	}
+	return shim.Success(verificationAsBytes)
+}
+
+//verifyChain looks up the binding for the exact chain and checks its validity and the telemarketers status at the given
+//time, the status of a telemarketer is read from the history of its registration
+func verifyChain(stub shim.ChaincodeStubInterface, entityID string, chain []string, at int64) (*Verification, error) {
+	verification := &Verification{EntityID: entityID, Chain: chain}
+	if entityID == "" || len(chain) == 0 {
+		verification.Reason = "entity and chain are mandatory"
+		return verification, nil
+	}
+	key, err := stub.CreateCompositeKey(KEYTMBINDING, append([]string{entityID}, chain...))
+	if err != nil {
+		return nil, err
+	}
+	value, err := stub.GetState(key)
+	if err != nil {
+		return nil, err
+	}
+	if value == nil {
+		verification.Reason = "chain is not bound to the entity"
+		return verification, nil
+	}
+	binding := Binding{}
+	if err := json.Unmarshal(value, &binding); err != nil {
+		return nil, err
+	}
+	validFrom, err := parseTime(binding.ValidFrom)
+	if err != nil {
+		return nil, err
+	}
+	validTo, err := parseTime(binding.ValidTo)
+	if err != nil {
+		return nil, err
+	}
+	if at < validFrom || at > validTo {
+		verification.Reason = "binding is not valid at " + formatTime(at)
+		return verification, nil
+	}
+	for _, tmID := range chain {
+		telemarketer, err := getTelemarketerAt(stub, tmID, at)
+		if err != nil {
+			return nil, err
+		}
+		if telemarketer == nil {
+			verification.Reason = "telemarketer is not registered at " + formatTime(at) + " : " + tmID
+			return verification, nil
+		}
+		if telemarketer.Status != TMACTIVE {
+			verification.Reason = "telemarketer is not active at " + formatTime(at) + " : " + tmID
+			return verification, nil
+		}
+	}
+	verification.Authorised = true
+	verification.Reason = "chain is bound to the entity"
+	return verification, nil
+}
@@ -0,0 +1,68 @@
+/*
+Copyright Tanla Solutions Ltd. 2019 All Rights Reserved.
+Common helpers shared by the Preferences chaincode functions
+for resolving the caller identity, transaction time and events.
+*/
+
+package main
+
+import (
+	"encoding/json" //reading and writing JSON
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"         // import for Chaincode Interface
+	"github.com/hyperledger/fabric/core/chaincode/shim/ext/cid" // import for Client Identity
+)
+
+//getOrganization returns the Organization of the certificate issuer of the invoking client
+func getOrganization(stub shim.ChaincodeStubInterface) (string, error) {
+	certData, err := cid.GetX509Certificate(stub)
+	if err != nil {
+		return "", err
+	}
+	if certData == nil || len(certData.Issuer.Organization) == 0 {
+		return "", errors.New("Certificate Issuer Organization is not available")
+	}
+	return certData.Issuer.Organization[0], nil
+}
+
+//getTxTime returns the transaction timestamp in seconds since epoch
+func getTxTime(stub shim.ChaincodeStubInterface) (int64, error) {
+	txTs, err := stub.GetTxTimestamp()
+	if err != nil {
+		return 0, err
+	}
+	return txTs.Seconds, nil
+}
+
+//parseTime parses the epoch seconds string used by the ledger records
+func parseTime(value string) (int64, error) {
+	return strconv.ParseInt(value, 10, 64)
+}
+
+//formatTime formats epoch seconds the way ledger records store them
+func formatTime(value int64) string {
+	return strconv.FormatInt(value, 10)
+}
+
+//publishEvent wraps the data into the Event payload structure and sets it on the transaction
+func publishEvent(stub shim.ChaincodeStubInterface, eventName string, data []byte) error {
+	eventbytes := Event{Data: string(data), Txid: stub.GetTxID()}
+	payload, err := json.Marshal(eventbytes)
+	if err != nil {
+		return err
+	}
+	return stub.SetEvent(eventName, payload)
+}
+
+//containsCode checks whether the comma separated code list of a preference contains the code
+func containsCode(codes string, code string) bool {
+	for _, value := range strings.Split(codes, ",") {
+		if strings.TrimSpace(value) == code {
+			return true
+		}
+	}
+	return false
+}